@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+)
+
+type (
+
+	// Credentials defines how dependencies are authenticated
+	Credentials struct {
+		Netrc      []NetrcEntry `json:"netrc"`      // Logins by host, for git over HTTP and archives
+		SSH        []SSHKey     `json:"ssh"`        // Private keys for git over SSH
+		Knownhosts string       `json:"knownhosts"` // known_hosts lines of the SSH servers
+		Headers    []HTTPHeader `json:"headers"`    // Headers sent to URLs, e.g. tokens
+	}
+
+	// NetrcEntry is a login on a host
+	NetrcEntry struct {
+		Machine  string `json:"machine"`
+		Login    string `json:"login"`
+		Password Secret `json:"password"`
+	}
+
+	// SSHKey is a private key, used for one host or all of them
+	SSHKey struct {
+		Host string `json:"host"` // Host name or pattern, all hosts if empty
+		Key  Secret `json:"key"`  // OpenSSH private key
+	}
+
+	// HTTPHeader is a header sent with every request to URLs starting
+	// with a prefix
+	HTTPHeader struct {
+		URL   string `json:"url"`   // URL prefix
+		Name  string `json:"name"`  // Header name, e.g. Authorization
+		Value Secret `json:"value"` // Header value
+	}
+
+	// Secret is a string hidden when the configuration is printed
+	Secret string
+)
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal("********")
+}
+
+// auth holds the credentials set up for the current build
+type auth struct {
+	gitEnv  []string     // Environment of git commands
+	netrc   []NetrcEntry // Logins of archive downloads
+	headers []HTTPHeader // Headers of archive downloads
+}
+
+var currentAuth auth
+
+// setupAuth writes the credentials in a temporary home directory that only
+// git commands use, leaving the user ~/.netrc and ~/.ssh alone. The
+// returned function removes them.
+func setupAuth(credentials Credentials, netrc Netrc) (func(), error) {
+
+	entries := credentials.Netrc
+	if netrc.Machine != "" {
+		entries = append(entries, NetrcEntry{netrc.Machine, netrc.Login, Secret(netrc.Password)})
+	}
+	if len(entries) == 0 && len(credentials.SSH) == 0 && len(credentials.Headers) == 0 {
+		return func() {}, nil
+	}
+
+	home, err := ioutil.TempDir("", "drone-kicad-home")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(home)
+		currentAuth = auth{}
+	}
+	env := []string{"HOME=" + home, "GIT_TERMINAL_PROMPT=0"}
+
+	// git over HTTP reads the logins from $HOME/.netrc
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "machine %s\nlogin %s\npassword %s\n\n", entry.Machine, entry.Login, entry.Password)
+	}
+	if err := ioutil.WriteFile(path.Join(home, ".netrc"), []byte(b.String()), 0600); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	b.Reset()
+	if u, err := user.Current(); err == nil {
+		if _, err := os.Stat(path.Join(u.HomeDir, ".gitconfig")); err == nil {
+			fmt.Fprintf(&b, "[include]\n\tpath = %s\n", gitQuote(path.Join(u.HomeDir, ".gitconfig")))
+		}
+	}
+	for _, header := range credentials.Headers {
+		fmt.Fprintf(&b, "[http %s]\n\textraHeader = %s\n", gitQuote(header.URL), gitQuote(header.Name+": "+string(header.Value)))
+	}
+	if err := ioutil.WriteFile(path.Join(home, ".gitconfig"), []byte(b.String()), 0600); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	if len(credentials.SSH) > 0 {
+		config, err := writeSSHConfig(path.Join(home, ".ssh"), credentials)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		env = append(env, "GIT_SSH_COMMAND=ssh -F "+config)
+	}
+
+	currentAuth = auth{env, entries, credentials.Headers}
+	return cleanup, nil
+}
+
+// writeSSHConfig writes the keys, known hosts and the ssh configuration
+// using them, and returns the configuration file.
+func writeSSHConfig(dir string, credentials Credentials) (string, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i, key := range credentials.SSH {
+		file := path.Join(dir, fmt.Sprintf("key_%d", i))
+		data := strings.TrimSpace(string(key.Key)) + "\n"
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			return "", err
+		}
+		host := key.Host
+		if host == "" {
+			host = "*"
+		}
+		fmt.Fprintf(&b, "Host %s\n\tIdentityFile %s\n\tIdentitiesOnly yes\n\n", host, file)
+	}
+
+	fmt.Fprintf(&b, "Host *\n\tStrictHostKeyChecking yes\n\tBatchMode yes\n")
+	if credentials.Knownhosts != "" {
+		file := path.Join(dir, "known_hosts")
+		if err := ioutil.WriteFile(file, []byte(strings.TrimSpace(credentials.Knownhosts)+"\n"), 0600); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\tUserKnownHostsFile %s\n", file)
+	}
+
+	config := path.Join(dir, "config")
+	return config, ioutil.WriteFile(config, []byte(b.String()), 0600)
+}
+
+// gitQuote quotes a git configuration value.
+func gitQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// gitCommand returns a git command using the build credentials.
+func gitCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	if len(currentAuth.gitEnv) > 0 {
+		cmd.Env = append(os.Environ(), currentAuth.gitEnv...)
+	}
+	return cmd
+}
+
+// authorize adds the login of the host and the headers matching the URL
+// to a download request.
+func (a auth) authorize(req *http.Request) {
+	for _, entry := range a.netrc {
+		if entry.Machine == req.URL.Hostname() {
+			req.SetBasicAuth(entry.Login, string(entry.Password))
+			break
+		}
+	}
+	for _, header := range a.headers {
+		if strings.HasPrefix(req.URL.String(), header.URL) {
+			req.Header.Set(header.Name, string(header.Value))
+		}
+	}
+}
+
+// checkCredentials returns what is wrong with the credentials.
+func checkCredentials(credentials Credentials) []string {
+	var problems []string
+	for i, entry := range credentials.Netrc {
+		if entry.Machine == "" {
+			problems = append(problems, fmt.Sprintf("credentials.netrc[%d].machine: required", i))
+		}
+	}
+	for i, key := range credentials.SSH {
+		if !strings.Contains(string(key.Key), "PRIVATE KEY-----") {
+			problems = append(problems, fmt.Sprintf("credentials.ssh[%d].key: expected an OpenSSH private key", i))
+		}
+	}
+	for i, header := range credentials.Headers {
+		if u, err := url.Parse(header.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("credentials.headers[%d].url: expected an absolute URL", i))
+		}
+		if header.Name == "" {
+			problems = append(problems, fmt.Sprintf("credentials.headers[%d].name: required", i))
+		}
+	}
+	return problems
+}
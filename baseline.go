@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// baselineFile records the accepted DRC and ERC violations, committed next
+// to the pipeline configuration
+const baselineFile = "kicad-baseline.json"
+
+// Baseline holds the accepted violations by output name, e.g. board or
+// board_Lite, then by check
+type Baseline map[string]map[string][]Violation
+
+// readBaseline reads the baseline file, empty if there is none.
+func readBaseline() (Baseline, error) {
+	baseline := make(Baseline)
+	data, err := ioutil.ReadFile(baselineFile)
+	if os.IsNotExist(err) {
+		return baseline, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("%s: %s", baselineFile, err)
+	}
+	return baseline, nil
+}
+
+// write writes the baseline file.
+func (b Baseline) write() error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(baselineFile, append(data, '\n'), 0644)
+}
+
+// accepted returns the baselined violations of a check report.
+func (b Baseline) accepted(kind string, report string) []Violation {
+	return b[reportName(report)][kind]
+}
+
+// reportName returns the output name of a report: board for
+// CI-BUILD/board/DRC/board.rpt.
+func reportName(report string) string {
+	return strings.TrimSuffix(path.Base(report), path.Ext(report))
+}
+
+// key identifies a violation across builds by its rule, sheet and items,
+// which hold the locations. Messages may carry measured values, they are
+// left out.
+func (v Violation) key() string {
+	items := append([]string(nil), v.Items...)
+	sort.Strings(items)
+	return strings.Join(append([]string{v.Rule, v.Sheet}, items...), "\n")
+}
+
+// compareBaseline returns the violations missing from the baseline, and
+// the baselined ones that are gone. A violation reported twice needs to be
+// baselined twice.
+func compareBaseline(accepted []Violation, violations []Violation) ([]Violation, []Violation) {
+
+	remaining := make(map[string]int)
+	for _, v := range accepted {
+		remaining[v.key()]++
+	}
+
+	var fresh []Violation
+	for _, v := range violations {
+		if remaining[v.key()] > 0 {
+			remaining[v.key()]--
+		} else {
+			fresh = append(fresh, v)
+		}
+	}
+
+	var resolved []Violation
+	for _, v := range accepted {
+		if remaining[v.key()] > 0 {
+			remaining[v.key()]--
+			resolved = append(resolved, v)
+		}
+	}
+
+	return fresh, resolved
+}
+
+// checkReports lists the reports of the enabled checks of the projects and
+// variants, by check, as written by the last build.
+func checkReports(projects []Project) map[string][]string {
+	reports := make(map[string][]string)
+	add := func(project Project, variant string, drc Check, erc Check) {
+		if drc.Enabled {
+			reports[CHECK_DRC] = append(reports[CHECK_DRC], outputPath(project.Main, variant, "DRC", ".rpt"))
+		}
+		if erc.Enabled {
+			reports[CHECK_ERC] = append(reports[CHECK_ERC], outputPath(project.Main, variant, "ERC", ".erc"))
+		}
+	}
+	for _, project := range projects {
+		add(project, "", project.Options.Drc, project.Options.Erc)
+		for _, variant := range project.Variants {
+			add(project, variant.Name, variant.Options.Drc, variant.Options.Erc)
+		}
+	}
+	return reports
+}
+
+// updateBaseline accepts every violation of the reports of the last build,
+// replacing what the baseline held for them.
+func updateBaseline(projects []Project) (Baseline, error) {
+
+	baseline, err := readBaseline()
+	if err != nil {
+		return nil, err
+	}
+
+	for kind, reports := range checkReports(projects) {
+		for _, report := range reports {
+			data, err := ioutil.ReadFile(report)
+			if err != nil {
+				return nil, fmt.Errorf("%s report: %s, run the build first", kind, err)
+			}
+			name := reportName(report)
+			if baseline[name] == nil {
+				baseline[name] = make(map[string][]Violation)
+			}
+			violations := parseReport(string(data))
+			fresh, resolved := compareBaseline(baseline[name][kind], violations)
+			baseline[name][kind] = violations
+			fmt.Printf("%s: %d violations, %d new, %d resolved\n", report, len(violations), len(fresh), len(resolved))
+		}
+	}
+
+	return baseline, baseline.write()
+}
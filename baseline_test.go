@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareBaseline(t *testing.T) {
+
+	clearance := Violation{Rule: "clearance", Severity: SEVERITY_ERROR, Message: "Clearance violation (0.1 mm)", Items: []string{"Pad 1 of R1", "Track on F.Cu"}}
+	moved := Violation{Rule: "clearance", Severity: SEVERITY_ERROR, Message: "Clearance violation (0.12 mm)", Items: []string{"Track on F.Cu", "Pad 1 of R1"}}
+	silk := Violation{Rule: "silk_overlap", Severity: SEVERITY_WARNING, Message: "Silkscreen overlap", Items: []string{"Text of U1"}}
+	pin := Violation{Rule: "ErrType(3)", Severity: SEVERITY_ERROR, Message: "Pin not connected", Sheet: "/power/", Items: []string{"U1 pin 4"}}
+	otherSheet := pin
+	otherSheet.Sheet = "/io/"
+
+	tests := []struct {
+		name       string
+		accepted   []Violation
+		violations []Violation
+		fresh      []Violation
+		resolved   []Violation
+	}{
+		{
+			name:       "no baseline",
+			violations: []Violation{clearance, silk},
+			fresh:      []Violation{clearance, silk},
+		},
+		{
+			name:       "all baselined",
+			accepted:   []Violation{clearance, silk},
+			violations: []Violation{silk, clearance},
+		},
+		{
+			name:       "message and item order ignored",
+			accepted:   []Violation{clearance},
+			violations: []Violation{moved},
+		},
+		{
+			name:       "new violation",
+			accepted:   []Violation{clearance},
+			violations: []Violation{clearance, silk},
+			fresh:      []Violation{silk},
+		},
+		{
+			name:       "resolved violation",
+			accepted:   []Violation{clearance, silk},
+			violations: []Violation{silk},
+			resolved:   []Violation{clearance},
+		},
+		{
+			name:       "repeated violation baselined once",
+			accepted:   []Violation{clearance},
+			violations: []Violation{clearance, clearance},
+			fresh:      []Violation{clearance},
+		},
+		{
+			name:       "repeated violation resolved once",
+			accepted:   []Violation{clearance, clearance},
+			violations: []Violation{clearance},
+			resolved:   []Violation{clearance},
+		},
+		{
+			name:       "sheet tells violations apart",
+			accepted:   []Violation{pin},
+			violations: []Violation{otherSheet},
+			fresh:      []Violation{otherSheet},
+			resolved:   []Violation{pin},
+		},
+	}
+
+	for _, tt := range tests {
+		fresh, resolved := compareBaseline(tt.accepted, tt.violations)
+		if !reflect.DeepEqual(fresh, tt.fresh) {
+			t.Errorf("%s: fresh %v, want %v", tt.name, fresh, tt.fresh)
+		}
+		if !reflect.DeepEqual(resolved, tt.resolved) {
+			t.Errorf("%s: resolved %v, want %v", tt.name, resolved, tt.resolved)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+// Footprint is a footprint placed on a board
+type Footprint struct {
+	Ref       string // Reference
+	Value     string // Value
+	ID        string // Library footprint (Library:Footprint)
+	BoardOnly bool   // Not expected in the schematic
+	Line      int    // Line of the footprint in the board file
+	Node      *Node  // Footprint s-expression
+}
+
+// boardFootprints returns the footprints of a KiCad 5 (module) or KiCad 6
+// (footprint) board, in file order.
+func boardFootprints(board *Node) []Footprint {
+	var footprints []Footprint
+	for _, n := range board.List {
+		if n.Name() != "module" && n.Name() != "footprint" {
+			continue
+		}
+		fp := Footprint{ID: n.Arg(0), Line: n.Line, Node: n}
+		for _, text := range n.Children("fp_text") {
+			switch text.Arg(0) {
+			case "reference":
+				fp.Ref = text.Arg(1)
+			case "value":
+				fp.Value = text.Arg(1)
+			}
+		}
+		for _, property := range n.Children("property") {
+			switch property.Arg(0) {
+			case "Reference":
+				fp.Ref = property.Arg(1)
+			case "Value":
+				fp.Value = property.Arg(1)
+			}
+		}
+		if attr := n.Child("attr"); attr != nil {
+			for _, a := range attr.List[1:] {
+				if a.Atom == "board_only" {
+					fp.BoardOnly = true
+				}
+			}
+		}
+		footprints = append(footprints, fp)
+	}
+	return footprints
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// ciFiles are the pipeline definitions and the check baseline: when one
+// changes, the settings of any project may have changed
+var ciFiles = []string{
+	baselineFile,
+	".drone.yml",
+	".woodpecker.yml",
+	".woodpecker",
+	".gitlab-ci.yml",
+	".github/workflows",
+}
+
+// changedProjects returns the projects whose files or locked dependency
+// commits changed since the previous commit. It falls back to all
+// projects when the changes can't be worked out, when the pipeline
+// definition changed, or on tags if FullBuildOnTag is set. Dependencies
+// that are not locked are not followed.
+func (p Plugin) changedProjects() []Project {
+
+	if len(p.Commit.Tag) > 0 && p.FullBuildOnTag {
+		fmt.Printf("tag %s: building all projects\n", p.Commit.Tag)
+		return p.Projects
+	}
+
+	changed, err := changedFiles(p.Commit.Before, p.Commit.Sha)
+	if err != nil {
+		fmt.Printf("can't list changed files (%s): building all projects\n", err)
+		return p.Projects
+	}
+
+	locks := make(map[string]bool)
+	for _, file := range changed {
+		if matchPrefix(ciFiles, file) {
+			fmt.Printf("%s changed: building all projects\n", file)
+			return p.Projects
+		}
+		if file == lockFile {
+			locks, err = changedLocks(p.Commit.Before)
+			if err != nil {
+				fmt.Printf("can't compare %s (%s): building all projects\n", lockFile, err)
+				return p.Projects
+			}
+		}
+	}
+
+	var projects []Project
+	for _, project := range p.Projects {
+		files := projectFiles(project)
+		var hits []string
+		for _, file := range changed {
+			if matchPrefix(files, file) {
+				hits = append(hits, file)
+			}
+		}
+		for _, dep := range project.Dependencies.list() {
+			if locks[dep.key()] {
+				hits = append(hits, fmt.Sprintf("%s (%s)", lockFile, dep.key()))
+			}
+		}
+		if len(hits) > 0 {
+			fmt.Printf("project %s changed: %s\n", project.Main, strings.Join(hits, " "))
+			projects = append(projects, project)
+		} else {
+			fmt.Printf("project %s unchanged: skipped\n", project.Main)
+		}
+	}
+
+	return projects
+}
+
+// changedFiles lists the files changed between two commits.
+func changedFiles(before string, sha string) ([]string, error) {
+
+	if strings.Trim(before, "0") == "" {
+		return nil, fmt.Errorf("no previous commit")
+	}
+	if sha == "" {
+		sha = "HEAD"
+	}
+
+	// Paths are NUL terminated, they may hold spaces
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", "diff", "-z", "--name-only", before, sha)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git diff: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	var files []string
+	for _, file := range strings.Split(stdout.String(), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// changedLocks returns the keys of the dependencies locked to another
+// commit, added or removed since the previous commit.
+func changedLocks(before string) (map[string]bool, error) {
+
+	current, err := readLock(lockFile)
+	if err != nil {
+		return nil, err
+	}
+	// The diff listed the lock, so a failure means it didn't exist before
+	previous := make(map[string]string)
+	var stdout bytes.Buffer
+	cmd := exec.Command("git", "show", before+":"+lockFile)
+	cmd.Stdout = &stdout
+	if cmd.Run() == nil {
+		if previous, err = parseLock(lockFile+"@"+before, &stdout); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make(map[string]bool)
+	for key, sha := range current {
+		if previous[key] != sha {
+			keys[key] = true
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
+// projectFiles lists the files and directories a project is built from:
+// its sheets, board, project and cache files, library tables, the
+// project-local libraries and 3D models they reference, and its variant
+// matrix and sidecar file.
+func projectFiles(project Project) []string {
+
+	main := path.Clean(project.Main)
+	dir := path.Dir(main)
+
+	files := []string{
+		main + ".sch",
+		main + ".kicad_sch",
+		main + ".kicad_pcb",
+		main + ".pro",
+		main + ".kicad_pro",
+		main + "-cache.lib",
+		main + "-rescue.lib",
+		main + sidecarSuffix,
+		path.Join(dir, "sym-lib-table"),
+		path.Join(dir, "fp-lib-table"),
+	}
+	if project.Matrix != "" {
+		files = append(files, path.Clean(project.Matrix))
+	}
+
+	if sch, err := readSchematic(main + ".sch"); err == nil {
+		files = append(files, sch.Sheets...)
+	}
+
+	for _, table := range []string{"sym-lib-table", "fp-lib-table"} {
+		node, err := readSexpr(path.Join(dir, table))
+		if err != nil {
+			continue
+		}
+		for _, lib := range node.Children("lib") {
+			if uri := lib.Child("uri"); uri != nil {
+				if local, ok := projectLocal(uri.Arg(0), dir); ok {
+					files = append(files, local)
+				}
+			}
+		}
+	}
+
+	if board, err := readSexpr(main + ".kicad_pcb"); err == nil {
+		board.Walk(func(n *Node) {
+			if n.Name() == "model" {
+				if local, ok := projectLocal(n.Arg(0), dir); ok {
+					files = append(files, local)
+				}
+			}
+		})
+	}
+
+	return files
+}
+
+// projectLocal resolves a library or model path relative to the project
+// directory, returning false for paths outside of it.
+func projectLocal(uri string, dir string) (string, bool) {
+	for _, prefix := range []string{"${KIPRJMOD}", "$(KIPRJMOD)"} {
+		if strings.HasPrefix(uri, prefix) {
+			return path.Join(dir, strings.TrimPrefix(uri, prefix)), true
+		}
+	}
+	if !path.IsAbs(uri) && !strings.HasPrefix(uri, "$") && !strings.Contains(uri, "://") {
+		return path.Join(dir, uri), true
+	}
+	return "", false
+}
+
+// matchPrefix tells whether file is one of paths or inside one of them.
+func matchPrefix(paths []string, file string) bool {
+	for _, p := range paths {
+		p = strings.TrimSuffix(path.Clean(p), "/")
+		if file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+	return false
+}
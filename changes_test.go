@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchPrefix(t *testing.T) {
+
+	tests := []struct {
+		paths []string
+		file  string
+		want  bool
+	}{
+		{[]string{"a/board.sch"}, "a/board.sch", true},
+		{[]string{"a/board.sch"}, "a/board.sch.bak", false},
+		{[]string{"a/lib"}, "a/lib/parts.lib", true},
+		{[]string{"a/lib/"}, "a/lib/parts.lib", true},
+		{[]string{"a/lib"}, "a/library/parts.lib", false},
+		{[]string{"./a/board.sch"}, "a/board.sch", true},
+		{[]string{".github/workflows"}, ".github/workflows/kicad.yml", true},
+		{nil, "a/board.sch", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPrefix(tt.paths, tt.file); got != tt.want {
+			t.Errorf("matchPrefix(%q, %q) = %v, want %v", tt.paths, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestProjectLocal(t *testing.T) {
+
+	tests := []struct {
+		uri   string
+		local string
+		ok    bool
+	}{
+		{"${KIPRJMOD}/lib/parts.lib", "boards/psu/lib/parts.lib", true},
+		{"$(KIPRJMOD)/parts.pretty", "boards/psu/parts.pretty", true},
+		{"lib/parts.lib", "boards/psu/lib/parts.lib", true},
+		{"../common/parts.lib", "boards/common/parts.lib", true},
+		{"${KISYSMOD}/Resistor_SMD.pretty", "", false},
+		{"/usr/share/kicad/library/device.lib", "", false},
+		{"https://example.com/parts.pretty", "", false},
+	}
+
+	for _, tt := range tests {
+		local, ok := projectLocal(tt.uri, "boards/psu")
+		if local != tt.local || ok != tt.ok {
+			t.Errorf("projectLocal(%q) = %q, %v, want %q, %v", tt.uri, local, ok, tt.local, tt.ok)
+		}
+	}
+}
+
+// testRepo creates a git repository holding files in a temporary directory
+// and commits them, returning the directory and the commit.
+func testRepo(t *testing.T, files map[string]string) (string, string, func()) {
+	dir, remove := testDir(t, files)
+	testGit(t, dir, "init", "-q")
+	return dir, testCommit(t, dir, nil), remove
+}
+
+// testCommit writes files into the repository, an empty content removing
+// the file, and commits them.
+func testCommit(t *testing.T, dir string, files map[string]string) string {
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if content == "" {
+			os.Remove(file)
+			continue
+		}
+		os.MkdirAll(filepath.Dir(file), 0777)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testGit(t, dir, "add", "-A")
+	testGit(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "test")
+	return testGit(t, dir, "rev-parse", "HEAD")
+}
+
+func testGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s", strings.Join(args, " "), out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestChangedProjects(t *testing.T) {
+
+	sheet := "EESchema Schematic File Version 4\n$Sheet\nF0 \"Power\" 50\nF1 \"power.sch\" 50\n$EndSheet\n$EndSCHEMATC\n"
+	base := map[string]string{
+		"a/a.sch":         sheet,
+		"a/power.sch":     "EESchema Schematic File Version 4\n$EndSCHEMATC\n",
+		"a/a.kicad_pcb":   "(kicad_pcb (module R (model ${KIPRJMOD}/3d/r.wrl)))",
+		"a/3d/r.wrl":      "r",
+		"a/sym-lib-table": "(sym_lib_table (lib (name local)(type Legacy)(uri ${KIPRJMOD}/lib/local.lib)))",
+		"a/lib/local.lib": "lib",
+		"b/b.sch":         "EESchema Schematic File Version 4\n$EndSCHEMATC\n",
+		"b/b.csv":         "variant,A\n",
+		"README.md":       "readme",
+		".drone.yml":      "pipeline:",
+	}
+	projects := []Project{{Main: "a/a"}, {Main: "b/b", Matrix: "b/b.csv"}}
+
+	tests := []struct {
+		name   string
+		change map[string]string
+		tag    string
+		full   bool
+		noSha  bool
+		want   []string
+	}{
+		{name: "sub-sheet", change: map[string]string{"a/power.sch": "EESchema Schematic File Version 4\n\n$EndSCHEMATC\n"}, want: []string{"a/a"}},
+		{name: "local library", change: map[string]string{"a/lib/local.lib": "changed"}, want: []string{"a/a"}},
+		{name: "3D model", change: map[string]string{"a/3d/r.wrl": "changed"}, want: []string{"a/a"}},
+		{name: "matrix", change: map[string]string{"b/b.csv": "variant,A,B\n"}, want: []string{"b/b"}},
+		{name: "sidecar added", change: map[string]string{"b/b.drone-kicad.json": "{}"}, want: []string{"b/b"}},
+		{name: "unrelated file", change: map[string]string{"README.md": "changed"}, want: nil},
+		{name: "pipeline", change: map[string]string{".drone.yml": "pipeline: {}"}, want: []string{"a/a", "b/b"}},
+		{name: "tag", change: map[string]string{"README.md": "changed"}, tag: "v1", full: true, want: []string{"a/a", "b/b"}},
+		{name: "tag without full build", change: map[string]string{"README.md": "changed"}, tag: "v1", want: nil},
+		{name: "no previous commit", change: map[string]string{"README.md": "changed"}, noSha: true, want: []string{"a/a", "b/b"}},
+	}
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	for _, tt := range tests {
+		dir, before, remove := testRepo(t, base)
+		sha := testCommit(t, dir, tt.change)
+		os.Chdir(dir)
+
+		p := Plugin{Projects: projects, FullBuildOnTag: tt.full}
+		p.Commit.Before, p.Commit.Sha, p.Commit.Tag = before, sha, tt.tag
+		if tt.noSha {
+			p.Commit.Before = strings.Repeat("0", 40)
+		}
+		var got []string
+		for _, project := range p.changedProjects() {
+			got = append(got, project.Main)
+		}
+
+		os.Chdir(cwd)
+		remove()
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
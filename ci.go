@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// Supported CI systems
+const (
+	CI_DRONE      = "drone"
+	CI_WOODPECKER = "woodpecker"
+	CI_GITLAB     = "gitlab"
+	CI_GITHUB     = "github"
+	CI_LOCAL      = "local"
+)
+
+// Environment describes the CI run: which system runs it, the commit
+// being built and the credentials to fetch dependencies with. Events use
+// the Drone names: push, pull_request, tag, cron, custom...
+type Environment struct {
+	CI     string // CI system
+	Build  Build  // Build event, branch and number
+	Commit Commit // Commit information
+	Netrc  Netrc  // Authentication
+}
+
+// ciEnvironments reads the environment of each CI system
+var ciEnvironments = map[string]func() Environment{
+	CI_DRONE:      droneEnvironment,
+	CI_WOODPECKER: woodpeckerEnvironment,
+	CI_GITLAB:     gitlabEnvironment,
+	CI_GITHUB:     githubEnvironment,
+	CI_LOCAL:      localEnvironment,
+}
+
+// detectCI tells which CI system runs the plugin, local when none.
+func detectCI() string {
+	switch {
+	// Woodpecker also sets some DRONE_* variables for compatibility
+	case os.Getenv("CI") == CI_WOODPECKER || os.Getenv("CI_SYSTEM_NAME") == CI_WOODPECKER:
+		return CI_WOODPECKER
+	case os.Getenv("DRONE") == "true":
+		return CI_DRONE
+	case os.Getenv("GITLAB_CI") == "true":
+		return CI_GITLAB
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return CI_GITHUB
+	}
+	return CI_LOCAL
+}
+
+// ciEnvironment reads the environment of the CI system given with --ci,
+// or detected, then applies the values given on the command line.
+func ciEnvironment(c *cli.Context) (Environment, error) {
+
+	name := c.GlobalString("ci")
+	if name == "" {
+		name = detectCI()
+	}
+	read, ok := ciEnvironments[name]
+	if !ok {
+		var names []string
+		for n := range ciEnvironments {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Environment{}, fmt.Errorf("ci: unknown CI system %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	env := read()
+
+	override := func(value *string, flag string) {
+		if c.GlobalIsSet(flag) {
+			*value = c.GlobalString(flag)
+		}
+	}
+	override(&env.Build.Event, "build.event")
+	override(&env.Build.Branch, "commit.branch")
+	override(&env.Build.Number, "build.number")
+	override(&env.Commit.Tag, "commit.tag")
+	override(&env.Commit.Sha, "commit.sha")
+	override(&env.Commit.Before, "commit.before")
+	override(&env.Netrc.Machine, "netrc.machine")
+	override(&env.Netrc.Login, "netrc.username")
+	override(&env.Netrc.Password, "netrc.password")
+
+	return env, nil
+}
+
+func droneEnvironment() Environment {
+	return Environment{
+		CI: CI_DRONE,
+		Build: Build{
+			Event:  os.Getenv("DRONE_BUILD_EVENT"),
+			Branch: firstEnv("DRONE_TARGET_BRANCH", "DRONE_COMMIT_BRANCH", "DRONE_BRANCH"),
+			Number: os.Getenv("DRONE_BUILD_NUMBER"),
+		},
+		Commit: Commit{
+			Tag:    os.Getenv("DRONE_TAG"),
+			Sha:    os.Getenv("DRONE_COMMIT_SHA"),
+			Before: firstEnv("DRONE_COMMIT_BEFORE", "DRONE_PREV_COMMIT_SHA"),
+		},
+		Netrc: Netrc{
+			Machine:  os.Getenv("DRONE_NETRC_MACHINE"),
+			Login:    os.Getenv("DRONE_NETRC_USERNAME"),
+			Password: os.Getenv("DRONE_NETRC_PASSWORD"),
+		},
+	}
+}
+
+func woodpeckerEnvironment() Environment {
+	branch := os.Getenv("CI_COMMIT_TARGET_BRANCH")
+	if branch == "" {
+		branch = os.Getenv("CI_COMMIT_BRANCH")
+	}
+	event := firstEnv("CI_PIPELINE_EVENT", "CI_BUILD_EVENT")
+	if event == "pull_request_closed" {
+		event = "pull_request"
+	}
+	return Environment{
+		CI: CI_WOODPECKER,
+		Build: Build{
+			Event:  event,
+			Branch: branch,
+			Number: firstEnv("CI_PIPELINE_NUMBER", "CI_BUILD_NUMBER"),
+		},
+		Commit: Commit{
+			Tag:    os.Getenv("CI_COMMIT_TAG"),
+			Sha:    os.Getenv("CI_COMMIT_SHA"),
+			Before: firstEnv("CI_PREV_COMMIT_SHA", "DRONE_PREV_COMMIT_SHA"),
+		},
+		Netrc: Netrc{
+			Machine:  os.Getenv("CI_NETRC_MACHINE"),
+			Login:    os.Getenv("CI_NETRC_USERNAME"),
+			Password: os.Getenv("CI_NETRC_PASSWORD"),
+		},
+	}
+}
+
+func gitlabEnvironment() Environment {
+
+	var event string
+	switch source := os.Getenv("CI_PIPELINE_SOURCE"); {
+	case os.Getenv("CI_COMMIT_TAG") != "":
+		event = "tag"
+	case source == "merge_request_event" || source == "external_pull_request_event":
+		event = "pull_request"
+	case source == "schedule":
+		event = "cron"
+	case source == "web" || source == "api" || source == "trigger" || source == "pipeline":
+		event = "custom"
+	default:
+		event = source
+	}
+
+	branch := os.Getenv("CI_MERGE_REQUEST_TARGET_BRANCH_NAME")
+	if branch == "" {
+		branch = os.Getenv("CI_COMMIT_BRANCH")
+	}
+
+	env := Environment{
+		CI: CI_GITLAB,
+		Build: Build{
+			Event:  event,
+			Branch: branch,
+			Number: os.Getenv("CI_PIPELINE_IID"),
+		},
+		Commit: Commit{
+			Tag:    os.Getenv("CI_COMMIT_TAG"),
+			Sha:    os.Getenv("CI_COMMIT_SHA"),
+			Before: os.Getenv("CI_COMMIT_BEFORE_SHA"),
+		},
+	}
+	// The job token can read the repositories of the same instance the
+	// job user has access to
+	if token := os.Getenv("CI_JOB_TOKEN"); token != "" {
+		env.Netrc = Netrc{
+			Machine:  os.Getenv("CI_SERVER_HOST"),
+			Login:    "gitlab-ci-token",
+			Password: token,
+		}
+	}
+
+	return env
+}
+
+func githubEnvironment() Environment {
+
+	var event string
+	switch name := os.Getenv("GITHUB_EVENT_NAME"); {
+	case os.Getenv("GITHUB_REF_TYPE") == "tag":
+		event = "tag"
+	case name == "pull_request" || name == "pull_request_target":
+		event = "pull_request"
+	case name == "schedule":
+		event = "cron"
+	case name == "workflow_dispatch" || name == "repository_dispatch":
+		event = "custom"
+	default:
+		event = name
+	}
+
+	env := Environment{
+		CI: CI_GITHUB,
+		Build: Build{
+			Event:  event,
+			Branch: os.Getenv("GITHUB_BASE_REF"),
+			Number: os.Getenv("GITHUB_RUN_NUMBER"),
+		},
+		Commit: Commit{
+			Sha: os.Getenv("GITHUB_SHA"),
+		},
+	}
+	if event == "tag" {
+		env.Commit.Tag = os.Getenv("GITHUB_REF_NAME")
+	} else if env.Build.Branch == "" {
+		env.Build.Branch = os.Getenv("GITHUB_REF_NAME")
+	}
+
+	// The previous commit of a push is only given in the event payload
+	if data, err := ioutil.ReadFile(os.Getenv("GITHUB_EVENT_PATH")); err == nil {
+		var payload struct {
+			Before string `json:"before"`
+		}
+		if json.Unmarshal(data, &payload) == nil {
+			env.Commit.Before = payload.Before
+		}
+	}
+
+	if token := firstEnv("INPUT_TOKEN", "GITHUB_TOKEN"); token != "" {
+		machine := strings.TrimPrefix(strings.TrimPrefix(os.Getenv("GITHUB_SERVER_URL"), "https://"), "http://")
+		if machine == "" {
+			machine = "github.com"
+		}
+		env.Netrc = Netrc{
+			Machine:  machine,
+			Login:    "x-access-token",
+			Password: token,
+		}
+	}
+
+	return env
+}
+
+// localEnvironment reads the commit from the git checkout in the working
+// directory. The event is tag when HEAD is tagged and push otherwise.
+func localEnvironment() Environment {
+
+	env := Environment{
+		CI: CI_LOCAL,
+		Build: Build{
+			Event:  "push",
+			Branch: gitOutput("rev-parse", "--abbrev-ref", "HEAD"),
+		},
+		Commit: Commit{
+			Tag:    gitOutput("describe", "--tags", "--exact-match", "HEAD"),
+			Sha:    gitOutput("rev-parse", "HEAD"),
+			Before: gitOutput("rev-parse", "--verify", "--quiet", "HEAD~1"),
+		},
+	}
+	if env.Commit.Tag != "" {
+		env.Build.Event = "tag"
+	}
+	if env.Build.Branch == "HEAD" {
+		env.Build.Branch = ""
+	}
+
+	return env
+}
+
+// gitOutput runs git and returns its trimmed output, or "" on failure.
+func gitOutput(args ...string) string {
+	var stdout bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout.String())
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// importInputs maps the INPUT_* variables GitHub Actions sets from the
+// step inputs to the PLUGIN_* settings, unless already set.
+func importInputs() {
+	if detectCI() != CI_GITHUB {
+		return
+	}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if !strings.HasPrefix(parts[0], "INPUT_") || parts[0] == "INPUT_TOKEN" {
+			continue
+		}
+		env := "PLUGIN_" + strings.Replace(strings.TrimPrefix(parts[0], "INPUT_"), "-", "_", -1)
+		if _, set := os.LookupEnv(env); !set {
+			os.Setenv(env, parts[1])
+		}
+	}
+}
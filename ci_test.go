@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ciPrefixes are the variables the CI systems set, cleared by testEnv
+var ciPrefixes = []string{"CI", "DRONE", "GITLAB_", "GITHUB_", "INPUT_", "PLUGIN_"}
+
+// testEnv replaces the CI variables of the environment with vars, until
+// the returned function restores them.
+func testEnv(vars map[string]string) func() {
+	saved := os.Environ()
+	for _, kv := range saved {
+		name := strings.SplitN(kv, "=", 2)[0]
+		for _, prefix := range ciPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				os.Unsetenv(name)
+			}
+		}
+	}
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+	return func() {
+		os.Clearenv()
+		for _, kv := range saved {
+			parts := strings.SplitN(kv, "=", 2)
+			os.Setenv(parts[0], parts[1])
+		}
+	}
+}
+
+func TestDetectCI(t *testing.T) {
+
+	tests := []struct {
+		vars map[string]string
+		want string
+	}{
+		{map[string]string{"DRONE": "true", "CI": "drone"}, CI_DRONE},
+		{map[string]string{"DRONE": "true", "CI": "woodpecker"}, CI_WOODPECKER},
+		{map[string]string{"CI_SYSTEM_NAME": "woodpecker"}, CI_WOODPECKER},
+		{map[string]string{"GITLAB_CI": "true", "CI": "true"}, CI_GITLAB},
+		{map[string]string{"GITHUB_ACTIONS": "true", "CI": "true"}, CI_GITHUB},
+		{map[string]string{"CI": "true"}, CI_LOCAL},
+		{nil, CI_LOCAL},
+	}
+
+	for _, tt := range tests {
+		restore := testEnv(tt.vars)
+		got := detectCI()
+		restore()
+		if got != tt.want {
+			t.Errorf("detectCI() with %v = %q, want %q", tt.vars, got, tt.want)
+		}
+	}
+}
+
+func TestCIEnvironments(t *testing.T) {
+
+	payload, err := ioutil.TempFile("", "event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(payload.Name())
+	payload.WriteString(`{"before": "1111111111111111111111111111111111111111"}`)
+	payload.Close()
+
+	tests := []struct {
+		name string
+		read func() Environment
+		vars map[string]string
+		want Environment
+	}{
+		{
+			name: "drone pull request",
+			read: droneEnvironment,
+			vars: map[string]string{
+				"DRONE_BUILD_EVENT": "pull_request", "DRONE_TARGET_BRANCH": "main", "DRONE_COMMIT_BRANCH": "feature",
+				"DRONE_BUILD_NUMBER": "7", "DRONE_COMMIT_SHA": "abc", "DRONE_COMMIT_BEFORE": "def",
+				"DRONE_NETRC_MACHINE": "git.example.com", "DRONE_NETRC_USERNAME": "u", "DRONE_NETRC_PASSWORD": "p",
+			},
+			want: Environment{
+				CI:     CI_DRONE,
+				Build:  Build{Event: "pull_request", Branch: "main", Number: "7"},
+				Commit: Commit{Sha: "abc", Before: "def"},
+				Netrc:  Netrc{Machine: "git.example.com", Login: "u", Password: "p"},
+			},
+		},
+		{
+			name: "drone tag",
+			read: droneEnvironment,
+			vars: map[string]string{"DRONE_BUILD_EVENT": "tag", "DRONE_TAG": "v1.0", "DRONE_PREV_COMMIT_SHA": "def"},
+			want: Environment{CI: CI_DRONE, Build: Build{Event: "tag"}, Commit: Commit{Tag: "v1.0", Before: "def"}},
+		},
+		{
+			name: "woodpecker closed pull request",
+			read: woodpeckerEnvironment,
+			vars: map[string]string{
+				"CI_PIPELINE_EVENT": "pull_request_closed", "CI_COMMIT_TARGET_BRANCH": "main", "CI_COMMIT_BRANCH": "feature",
+				"CI_PIPELINE_NUMBER": "3", "CI_COMMIT_SHA": "abc", "CI_PREV_COMMIT_SHA": "def",
+			},
+			want: Environment{
+				CI:     CI_WOODPECKER,
+				Build:  Build{Event: "pull_request", Branch: "main", Number: "3"},
+				Commit: Commit{Sha: "abc", Before: "def"},
+			},
+		},
+		{
+			name: "woodpecker 1.x names",
+			read: woodpeckerEnvironment,
+			vars: map[string]string{"CI_BUILD_EVENT": "push", "CI_COMMIT_BRANCH": "main", "CI_BUILD_NUMBER": "4"},
+			want: Environment{CI: CI_WOODPECKER, Build: Build{Event: "push", Branch: "main", Number: "4"}},
+		},
+		{
+			name: "gitlab merge request",
+			read: gitlabEnvironment,
+			vars: map[string]string{
+				"CI_PIPELINE_SOURCE": "merge_request_event", "CI_MERGE_REQUEST_TARGET_BRANCH_NAME": "main",
+				"CI_PIPELINE_IID": "12", "CI_COMMIT_SHA": "abc", "CI_COMMIT_BEFORE_SHA": "def",
+				"CI_JOB_TOKEN": "token", "CI_SERVER_HOST": "gitlab.example.com",
+			},
+			want: Environment{
+				CI:     CI_GITLAB,
+				Build:  Build{Event: "pull_request", Branch: "main", Number: "12"},
+				Commit: Commit{Sha: "abc", Before: "def"},
+				Netrc:  Netrc{Machine: "gitlab.example.com", Login: "gitlab-ci-token", Password: "token"},
+			},
+		},
+		{
+			name: "gitlab tag and schedule",
+			read: gitlabEnvironment,
+			vars: map[string]string{"CI_PIPELINE_SOURCE": "schedule", "CI_COMMIT_TAG": "v1.0"},
+			want: Environment{CI: CI_GITLAB, Build: Build{Event: "tag"}, Commit: Commit{Tag: "v1.0"}},
+		},
+		{
+			name: "gitlab schedule",
+			read: gitlabEnvironment,
+			vars: map[string]string{"CI_PIPELINE_SOURCE": "schedule", "CI_COMMIT_BRANCH": "main"},
+			want: Environment{CI: CI_GITLAB, Build: Build{Event: "cron", Branch: "main"}},
+		},
+		{
+			name: "github push",
+			read: githubEnvironment,
+			vars: map[string]string{
+				"GITHUB_EVENT_NAME": "push", "GITHUB_REF_NAME": "main", "GITHUB_RUN_NUMBER": "5",
+				"GITHUB_SHA": "abc", "GITHUB_EVENT_PATH": payload.Name(), "GITHUB_TOKEN": "token",
+			},
+			want: Environment{
+				CI:     CI_GITHUB,
+				Build:  Build{Event: "push", Branch: "main", Number: "5"},
+				Commit: Commit{Sha: "abc", Before: "1111111111111111111111111111111111111111"},
+				Netrc:  Netrc{Machine: "github.com", Login: "x-access-token", Password: "token"},
+			},
+		},
+		{
+			name: "github pull request on enterprise",
+			read: githubEnvironment,
+			vars: map[string]string{
+				"GITHUB_EVENT_NAME": "pull_request_target", "GITHUB_BASE_REF": "main", "GITHUB_REF_NAME": "42/merge",
+				"INPUT_TOKEN": "input", "GITHUB_TOKEN": "token", "GITHUB_SERVER_URL": "https://github.example.com",
+			},
+			want: Environment{
+				CI:    CI_GITHUB,
+				Build: Build{Event: "pull_request", Branch: "main"},
+				Netrc: Netrc{Machine: "github.example.com", Login: "x-access-token", Password: "input"},
+			},
+		},
+		{
+			name: "github tag",
+			read: githubEnvironment,
+			vars: map[string]string{"GITHUB_EVENT_NAME": "push", "GITHUB_REF_TYPE": "tag", "GITHUB_REF_NAME": "v1.0"},
+			want: Environment{CI: CI_GITHUB, Build: Build{Event: "tag"}, Commit: Commit{Tag: "v1.0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		restore := testEnv(tt.vars)
+		got := tt.read()
+		restore()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLocalEnvironment(t *testing.T) {
+
+	dir, first, remove := testRepo(t, map[string]string{"board.sch": "sch"})
+	defer remove()
+	testGit(t, dir, "checkout", "-q", "-b", "main")
+	second := testCommit(t, dir, map[string]string{"board.sch": "changed"})
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+
+	want := Environment{CI: CI_LOCAL, Build: Build{Event: "push", Branch: "main"}, Commit: Commit{Sha: second, Before: first}}
+	if got := localEnvironment(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	testGit(t, dir, "tag", "v1.0")
+	want.Build.Event, want.Commit.Tag = "tag", "v1.0"
+	if got := localEnvironment(); !reflect.DeepEqual(got, want) {
+		t.Errorf("tagged: got %+v, want %+v", got, want)
+	}
+
+	testGit(t, dir, "checkout", "-q", "--detach")
+	want.Build.Branch = ""
+	if got := localEnvironment(); !reflect.DeepEqual(got, want) {
+		t.Errorf("detached: got %+v, want %+v", got, want)
+	}
+}
+
+func TestImportInputs(t *testing.T) {
+
+	restore := testEnv(map[string]string{
+		"GITHUB_ACTIONS":     "true",
+		"INPUT_CHANGED_ONLY": "true",
+		"INPUT_FETCH-JOBS":   "2",
+		"INPUT_LOCK":         "frozen",
+		"PLUGIN_LOCK":        "off",
+		"INPUT_TOKEN":        "token",
+	})
+	defer restore()
+
+	importInputs()
+
+	for name, want := range map[string]string{
+		"PLUGIN_CHANGED_ONLY": "true",
+		"PLUGIN_FETCH_JOBS":   "2",
+		"PLUGIN_LOCK":         "off",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, set := os.LookupEnv("PLUGIN_TOKEN"); set {
+		t.Errorf("PLUGIN_TOKEN set from INPUT_TOKEN")
+	}
+}
+
+func TestCommitShort(t *testing.T) {
+
+	tests := []struct {
+		sha  string
+		want string
+	}{
+		{"0123456789abcdef0123456789abcdef01234567", "01234567"},
+		{"0123", "0123"},
+		{"", "dummy"},
+	}
+
+	for _, tt := range tests {
+		if got := (Commit{Sha: tt.sha}).short(); got != tt.want {
+			t.Errorf("short(%q) = %q, want %q", tt.sha, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+type (
+
+	// Config defines the plugin settings as written in the pipeline step.
+	// Each field is passed by Drone as a PLUGIN_<NAME> environment variable
+	// holding its JSON encoding.
+	Config struct {
+		Defaults    Defaults       `json:"defaults"`    // Applied to every project
+		Projects    []Project      `json:"projects"`    // Projects configuration
+		Discover    *Discover      `json:"discover"`    // Find more projects in the workspace
+		Profiles    []Profile      `json:"profiles"`    // Adapt the build to the CI event
+		Credentials Credentials    `json:"credentials"` // Authentication of dependencies
+		Fabs        map[string]Fab `json:"fabs"`        // Fab presets by name
+	}
+
+	// Defaults defines the project settings shared by all projects. Each
+	// project overrides only the keys it sets.
+	Defaults struct {
+		Client       Client         `json:"client"`       // Enterprise client
+		Dependencies Dependencies   `json:"dependencies"` // Projects dependencies
+		Options      ProjectOptions `json:"options"`      // Project options
+	}
+
+	// ConfigError lists every problem found in the configuration
+	ConfigError struct {
+		Problems []string
+	}
+)
+
+// jsonSettings lists the flags holding a JSON encoded Config field. Flag
+// names match the Config keys.
+var jsonSettings = []string{
+	"defaults",
+	"projects",
+	"discover",
+	"profiles",
+	"credentials",
+	"fabs",
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// loadConfig builds the configuration from the JSON settings flags.
+func loadConfig(c *cli.Context, build Build) (Config, error) {
+
+	settings := make(map[string]interface{})
+	for _, name := range jsonSettings {
+		raw := strings.TrimSpace(c.GlobalString(name))
+		if raw == "" {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			return Config{}, fmt.Errorf("%s: %s", name, err)
+		}
+		settings[name] = value
+	}
+
+	return decodeConfig(settings, build)
+}
+
+// loadConfigFile builds the configuration from a JSON file holding the
+// settings object.
+func loadConfigFile(file string, build Build) (Config, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var settings interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return Config{}, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return decodeConfig(settings, build)
+}
+
+// decodeConfig checks the generic settings tree against Config and decodes
+// it. Unknown keys and mistyped values are reported together with their
+// full path. The options of the profile matching the build apply last.
+func decodeConfig(settings interface{}, build Build) (Config, error) {
+
+	var config Config
+	var problems []string
+
+	tree := normalizeTree("", settings, reflect.TypeOf(config), &problems)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return config, ConfigError{problems}
+	}
+
+	tree = discoverProjects(tree, &problems)
+	tree = expandMatrices(tree, &problems)
+	if len(problems) > 0 {
+		return config, ConfigError{problems}
+	}
+
+	tree = applyProfile(inheritSettings(tree), build, &problems)
+	if len(problems) > 0 {
+		return config, ConfigError{problems}
+	}
+	tree = applyFabGerbers(tree)
+
+	if err := decodeTree(tree, &config); err != nil {
+		return config, err
+	}
+
+	if problems := checkConfig(config); len(problems) > 0 {
+		return config, ConfigError{problems}
+	}
+
+	return config, nil
+}
+
+// checkConfig validates the values of a decoded configuration.
+func checkConfig(config Config) []string {
+
+	problems := checkCredentials(config.Credentials)
+	for name, fab := range config.Fabs {
+		for _, problem := range checkFab(fab) {
+			problems = append(problems, fmt.Sprintf("fabs.%s.%s", name, problem))
+		}
+	}
+	fabNames := make([]string, 0, len(config.Fabs))
+	for name := range config.Fabs {
+		fabNames = append(fabNames, name)
+	}
+	sort.Strings(fabNames)
+	checkFabName := func(at string, name string) {
+		if _, ok := config.Fabs[name]; name != "" && !ok {
+			problems = append(problems, unknownFab(at, name, fabNames))
+		}
+	}
+	for i, project := range config.Projects {
+		for _, dep := range project.Dependencies.list() {
+			if problem := checkDependency(dep.Dependency); problem != "" {
+				problems = append(problems, fmt.Sprintf("projects[%d].dependencies.%s: %s", i, dep.At, problem))
+			}
+		}
+		for key, check := range map[string]Check{"drc": project.Options.Drc, "erc": project.Options.Erc} {
+			if problem := checkSeverity(check); problem != "" {
+				problems = append(problems, fmt.Sprintf("projects[%d].options.%s.%s", i, key, problem))
+			}
+		}
+		checkFabName(fmt.Sprintf("projects[%d].options.fab", i), project.Options.Fab)
+		for _, problem := range checkGerberLayers(project.Options.Grb) {
+			problems = append(problems, fmt.Sprintf("projects[%d].options.grb.%s", i, problem))
+		}
+		for j, rule := range project.Options.Fields {
+			for _, problem := range checkFieldRule(rule) {
+				problems = append(problems, fmt.Sprintf("projects[%d].options.fields[%d].%s", i, j, problem))
+			}
+		}
+		for j, variant := range project.Variants {
+			at := fmt.Sprintf("projects[%d].variants[%d]", i, j)
+			for key, check := range map[string]Check{"drc": variant.Options.Drc, "erc": variant.Options.Erc} {
+				if problem := checkSeverity(check); problem != "" {
+					problems = append(problems, fmt.Sprintf("%s.options.%s.%s", at, key, problem))
+				}
+			}
+			checkFabName(at+".options.fab", variant.Options.Fab)
+			for _, problem := range checkGerberLayers(variant.Options.Grb) {
+				problems = append(problems, fmt.Sprintf("%s.options.grb.%s", at, problem))
+			}
+			for k, rule := range variant.Options.Fields {
+				for _, problem := range checkFieldRule(rule) {
+					problems = append(problems, fmt.Sprintf("%s.options.fields[%d].%s", at, k, problem))
+				}
+			}
+			if variant.Name == "" {
+				problems = append(problems, at+".name: required")
+			}
+			if _, err := parseVariantExpr(variant.Content); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.content: %s", at, err))
+			}
+			for ref, status := range variant.Parts {
+				if status != PART_FITTED && status != PART_REMOVED && status != PART_DNP {
+					problems = append(problems, fmt.Sprintf("%s.parts.%s: %q is not one of %s, %s, %s", at, ref, status, PART_FITTED, PART_REMOVED, PART_DNP))
+				}
+			}
+		}
+	}
+	problems = append(problems, checkVariantNames(config.Projects)...)
+	sort.Strings(problems)
+
+	return problems
+}
+
+// checkVariantNames reports projects named <main>_<variant> after a variant
+// of another project, whose outputs would be written to the same place.
+func checkVariantNames(projects []Project) []string {
+
+	variants := make(map[string]string)
+	for _, project := range projects {
+		for _, variant := range project.Variants {
+			if variant.Name != "" {
+				variants[path.Clean(project.Main+"_"+variant.Name)] = fmt.Sprintf("variant %s of project %s", variant.Name, project.Main)
+			}
+		}
+	}
+
+	var problems []string
+	for i, project := range projects {
+		if variant, ok := variants[path.Clean(project.Main)]; ok {
+			problems = append(problems, fmt.Sprintf("projects[%d].main: %s has the same outputs as %s", i, project.Main, variant))
+		}
+	}
+	return problems
+}
+
+// checkReferences resolves every variant against its project schematic,
+// reporting references in parts and overrides that don't exist.
+func checkReferences(config Config) []string {
+
+	var problems []string
+	for i, project := range config.Projects {
+		if len(project.Variants) == 0 {
+			continue
+		}
+		sch, err := readSchematic(project.Main + ".sch")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("projects[%d].main: %s", i, err))
+			continue
+		}
+		for j, variant := range project.Variants {
+			if _, err := variantParts(sch, variant); err != nil {
+				problems = append(problems, fmt.Sprintf("projects[%d].variants[%d]: %s", i, j, err))
+			}
+		}
+	}
+
+	return problems
+}
+
+// notInherited are the variant options not taken from the project: a
+// schematic, BOM or ERC of the project doesn't call for one per variant,
+// each variant asks for its own.
+var notInherited = map[string]bool{
+	"sch": true,
+	"bom": true,
+	"erc": true,
+}
+
+// inheritSettings merges the defaults into each project, then each
+// project's options into its variants. Only the keys a variant supports
+// are inherited, notInherited aside.
+func inheritSettings(tree interface{}) interface{} {
+
+	settings, ok := tree.(map[string]interface{})
+	if !ok {
+		return tree
+	}
+	projects, _ := settings["projects"].([]interface{})
+
+	var variantKeys []string
+	for _, key := range fieldNames(structKeys(reflect.TypeOf(VariantOptions{}))) {
+		if !notInherited[key] {
+			variantKeys = append(variantKeys, key)
+		}
+	}
+
+	for i, p := range projects {
+		project := mergeTree(settings["defaults"], p)
+		projects[i] = project
+
+		object, ok := project.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		options, _ := object["options"].(map[string]interface{})
+		inherited := make(map[string]interface{})
+		for _, key := range variantKeys {
+			if value, ok := options[key]; ok {
+				inherited[key] = value
+			}
+		}
+
+		variants, _ := object["variants"].([]interface{})
+		for _, v := range variants {
+			variant, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// options: null opts out of inheritance altogether
+			if value, set := variant["options"]; set && value == nil {
+				continue
+			}
+			variant["options"] = mergeTree(inherited, variant["options"])
+		}
+	}
+
+	return settings
+}
+
+// mergeTree overlays over on base. Objects are merged key by key: a null
+// value drops the inherited key, so that it falls back to its built-in
+// default, and any other value replaces it. Lists are replaced whole.
+func mergeTree(base, over interface{}) interface{} {
+
+	overObject, ok := over.(map[string]interface{})
+	if !ok {
+		if over == nil {
+			return base
+		}
+		return over
+	}
+	baseObject, _ := base.(map[string]interface{})
+
+	out := make(map[string]interface{}, len(baseObject)+len(overObject))
+	for key, value := range baseObject {
+		out[key] = value
+	}
+	for key, value := range overObject {
+		if value == nil {
+			delete(out, key)
+			continue
+		}
+		out[key] = mergeTree(out[key], value)
+	}
+
+	return out
+}
+
+// decodeTree decodes a normalized settings tree into v.
+func decodeTree(tree interface{}, v interface{}) error {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// normalizeTree walks value alongside type t. Object keys are rewritten to
+// the canonical (lower case) key of the field they decode into, so that
+// later merges see a single spelling. Unknown keys and values of the wrong
+// JSON type are appended to problems.
+func normalizeTree(path string, value interface{}, t reflect.Type, problems *[]string) interface{} {
+
+	if value == nil {
+		return nil
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+
+	case reflect.Struct:
+		if key, ok := shorthandKeys[t]; ok {
+			switch value.(type) {
+			case string, bool:
+				value = map[string]interface{}{key: value}
+			}
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: expected an object, got %s", displayPath(path), jsonKind(value)))
+			return value
+		}
+		fields := structKeys(t)
+		out := make(map[string]interface{}, len(object))
+		for key, item := range object {
+			field, ok := lookupKey(fields, key)
+			if !ok {
+				*problems = append(*problems, unknownKey(joinPath(path, key), key, fieldNames(fields)))
+				continue
+			}
+			out[field.key] = normalizeTree(joinPath(path, field.key), item, field.typ, problems)
+		}
+		for _, key := range requiredKeys[t] {
+			if out[key] == nil {
+				*problems = append(*problems, fmt.Sprintf("%s: required", joinPath(path, key)))
+			}
+		}
+		return out
+
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]interface{})
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: expected a list, got %s", displayPath(path), jsonKind(value)))
+			return value
+		}
+		elem := t.Elem()
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			// null only resets object keys, an item of a list can't be
+			// left out
+			if item == nil && elem.Kind() == reflect.Struct {
+				*problems = append(*problems, fmt.Sprintf("%s[%d]: expected an object, got null", path, i))
+				continue
+			}
+			out[i] = normalizeTree(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), problems)
+		}
+		return out
+
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: expected an object, got %s", displayPath(path), jsonKind(value)))
+			return value
+		}
+		out := make(map[string]interface{}, len(object))
+		for key, item := range object {
+			out[key] = normalizeTree(joinPath(path, key), item, t.Elem(), problems)
+		}
+		return out
+
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: expected true or false, got %s", displayPath(path), jsonKind(value)))
+		}
+
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: expected a string, got %s", displayPath(path), jsonKind(value)))
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			*problems = append(*problems, fmt.Sprintf("%s: expected an integer, got %s", displayPath(path), jsonKind(value)))
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: expected a number, got %s", displayPath(path), jsonKind(value)))
+		}
+	}
+
+	return value
+}
+
+// structField describes how a JSON key maps to a struct field
+type structField struct {
+	key string
+	typ reflect.Type
+}
+
+// structKeys returns the JSON keys accepted by struct type t.
+func structKeys(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		key := strings.ToLower(f.Name)
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			key = tag
+		}
+		fields = append(fields, structField{key, f.Type})
+	}
+	return fields
+}
+
+// lookupKey finds the field for key using encoding/json rules: an exact
+// match first, then a case-insensitive one.
+func lookupKey(fields []structField, key string) (structField, bool) {
+	for _, f := range fields {
+		if f.key == key {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.key, key) {
+			return f, true
+		}
+	}
+	return structField{}, false
+}
+
+func fieldNames(fields []structField) []string {
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.key)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownKey formats the problem for an unknown key, with a suggestion
+// when one of the known keys is close enough.
+func unknownKey(path string, key string, known []string) string {
+	if s := suggest(key, known); s != "" {
+		return fmt.Sprintf("%s: unknown key, did you mean %q?", displayPath(path), s)
+	}
+	return fmt.Sprintf("%s: unknown key (expected one of: %s)", displayPath(path), strings.Join(known, ", "))
+}
+
+// suggest returns the candidate closest to key, or an empty string if none
+// is a plausible typo. Separators and case are ignored, so `svg_lib_dirs`
+// matches `svglibdirs`.
+func suggest(key string, candidates []string) string {
+
+	best := ""
+	bestDist := -1
+	k := squash(key)
+	for _, c := range candidates {
+		d := editDistance(k, squash(c))
+		if bestDist < 0 || d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+
+	limit := 2
+	if len(k) <= 3 {
+		limit = 1
+	}
+	if bestDist < 0 || bestDist > limit {
+		return ""
+	}
+	return best
+}
+
+func squash(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "_", "", -1)
+	s = strings.Replace(s, "-", "", -1)
+	return s
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and transpositions of adjacent
+// characters all cost one.
+func editDistance(a, b string) int {
+
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(ra)][len(rb)]
+}
+
+func minInt(first int, others ...int) int {
+	for _, n := range others {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "configuration"
+	}
+	return path
+}
+
+func jsonKind(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return fmt.Sprintf("number %v", v)
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// checkPluginEnv reports PLUGIN_* variables that don't match any flag.
+// Drone turns every key of the step into one of those, so a misspelled top
+// level setting would otherwise be silently ignored.
+func checkPluginEnv(flags []cli.Flag) []string {
+
+	known := make(map[string]bool)
+	var names []string
+	for _, f := range flags {
+		for _, env := range strings.Split(flagEnvVar(f), ",") {
+			env = strings.TrimSpace(env)
+			if strings.HasPrefix(env, "PLUGIN_") {
+				known[env] = true
+				names = append(names, strings.ToLower(strings.TrimPrefix(env, "PLUGIN_")))
+			}
+		}
+	}
+
+	var problems []string
+	for _, kv := range os.Environ() {
+		env := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(env, "PLUGIN_") || known[env] {
+			continue
+		}
+		setting := strings.ToLower(strings.TrimPrefix(env, "PLUGIN_"))
+		if s := suggest(setting, names); s != "" {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %q, did you mean %q?", env, setting, s))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %q", env, setting))
+		}
+	}
+	sort.Strings(problems)
+
+	return problems
+}
+
+func flagEnvVar(f cli.Flag) string {
+	switch f := f.(type) {
+	case cli.StringFlag:
+		return f.EnvVar
+	case cli.BoolFlag:
+		return f.EnvVar
+	case cli.BoolTFlag:
+		return f.EnvVar
+	case cli.IntFlag:
+		return f.EnvVar
+	}
+	return ""
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// jsonTree decodes a settings tree as loadConfig does, numbers as float64.
+func jsonTree(t *testing.T, s string) interface{} {
+	var tree interface{}
+	if err := json.Unmarshal([]byte(s), &tree); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return tree
+}
+
+// sameProblems compares problems regardless of their order, as map keys
+// are walked in any order.
+func sameProblems(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, p := range a {
+		count[p]++
+	}
+	for _, p := range b {
+		if count[p] == 0 {
+			return false
+		}
+		count[p]--
+	}
+	return true
+}
+
+func TestNormalizeTree(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		settings string
+		want     string   // Normalized tree, when there are no problems
+		problems []string // Expected problems
+	}{
+		{
+			name:     "keys folded to their canonical spelling",
+			settings: `{"Projects": [{"MAIN": "board", "Options": {"Sch": true, "GRB": {"fCu": true}}}]}`,
+			want:     `{"projects": [{"main": "board", "options": {"sch": true, "grb": {"fcu": true}}}]}`,
+		},
+		{
+			name:     "check shorthand",
+			settings: `{"defaults": {"options": {"drc": true, "erc": {"fail": "warning"}}}}`,
+			want:     `{"defaults": {"options": {"drc": {"enabled": true}, "erc": {"fail": "warning"}}}}`,
+		},
+		{
+			name:     "dependency shorthand",
+			settings: `{"defaults": {"dependencies": {"libraries": ["https://example.com/libs.git"]}}}`,
+			want:     `{"defaults": {"dependencies": {"libraries": [{"url": "https://example.com/libs.git"}]}}}`,
+		},
+		{
+			name:     "zones shorthand",
+			settings: `{"defaults": {"options": {"zones": true}}}`,
+			want:     `{"defaults": {"options": {"zones": {"refill": true}}}}`,
+		},
+		{
+			name:     "null kept",
+			settings: `{"projects": [{"main": "board", "options": {"grb": null}}]}`,
+			want:     `{"projects": [{"main": "board", "options": {"grb": null}}]}`,
+		},
+		{
+			name:     "map keys kept as written",
+			settings: `{"fabs": {"JLCPCB": {"Track": 0.127}}}`,
+			want:     `{"fabs": {"JLCPCB": {"track": 0.127}}}`,
+		},
+		{
+			name:     "typo with suggestion",
+			settings: `{"projects": [{"main": "board", "optons": {}}]}`,
+			problems: []string{`projects[0].optons: unknown key, did you mean "options"?`},
+		},
+		{
+			name:     "separators ignored in suggestions",
+			settings: `{"projects": [{"main": "board", "opt_ions": {}}]}`,
+			problems: []string{`projects[0].opt_ions: unknown key, did you mean "options"?`},
+		},
+		{
+			name:     "unknown key",
+			settings: `{"projects": [{"main": "board", "client": {"zzzzzz": "X"}}]}`,
+			problems: []string{"projects[0].client.zzzzzz: unknown key (expected one of: code, name)"},
+		},
+		{
+			name:     "unknown option",
+			settings: `{"defaults": {"options": {"zzzzzz": 1}}}`,
+			problems: []string{"defaults.options.zzzzzz: unknown key (expected one of: bom, drc, erc, fab, fields, grb, pcb, sch, svg, tags, wait, zones)"},
+		},
+		{
+			name:     "required key",
+			settings: `{"projects": [{"options": {}}]}`,
+			problems: []string{"projects[0].main: required"},
+		},
+		{
+			name:     "wrong types",
+			settings: `{"projects": [{"main": 1, "options": {"sch": "yes", "wait": 1.5, "drc": {"allow": 1.5}}}]}`,
+			problems: []string{
+				`projects[0].main: expected a string, got number 1`,
+				`projects[0].options.drc.allow: expected an integer, got number 1.5`,
+				`projects[0].options.sch: expected true or false, got string "yes"`,
+				`projects[0].options.wait: expected an integer, got number 1.5`,
+			},
+		},
+		{
+			name:     "wrong type in a map",
+			settings: `{"fabs": {"x": {"track": "a"}}}`,
+			problems: []string{`fabs.x.track: expected a number, got string "a"`},
+		},
+		{
+			name:     "list expected",
+			settings: `{"projects": {}}`,
+			problems: []string{"projects: expected a list, got an object"},
+		},
+		{
+			name:     "null project",
+			settings: `{"projects": [{"main": "board"}, null]}`,
+			problems: []string{"projects[1]: expected an object, got null"},
+		},
+		{
+			name:     "object expected",
+			settings: `{"projects": [{"main": "board", "options": true}]}`,
+			problems: []string{"projects[0].options: expected an object, got a boolean"},
+		},
+	}
+
+	for _, tt := range tests {
+		var problems []string
+		got := normalizeTree("", jsonTree(t, tt.settings), reflect.TypeOf(Config{}), &problems)
+		if len(tt.problems) > 0 || len(problems) > 0 {
+			if !sameProblems(problems, tt.problems) {
+				t.Errorf("%s: problems %q, want %q", tt.name, problems, tt.problems)
+			}
+			continue
+		}
+		if want := jsonTree(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestMergeTree(t *testing.T) {
+
+	tests := []struct {
+		name string
+		base string
+		over string
+		want string
+	}{
+		{
+			name: "keys merged",
+			base: `{"sch": true, "grb": {"all": true}}`,
+			over: `{"bom": true, "grb": {"protel": true}}`,
+			want: `{"sch": true, "bom": true, "grb": {"all": true, "protel": true}}`,
+		},
+		{
+			name: "values replaced",
+			base: `{"sch": true, "wait": 5}`,
+			over: `{"sch": false}`,
+			want: `{"sch": false, "wait": 5}`,
+		},
+		{
+			name: "null drops the key",
+			base: `{"sch": true, "grb": {"all": true}}`,
+			over: `{"grb": null}`,
+			want: `{"sch": true}`,
+		},
+		{
+			name: "null drops a nested key",
+			base: `{"grb": {"all": true, "protel": true}}`,
+			over: `{"grb": {"protel": null}}`,
+			want: `{"grb": {"all": true}}`,
+		},
+		{
+			name: "lists replaced whole",
+			base: `{"libraries": ["a", "b"]}`,
+			over: `{"libraries": ["c"]}`,
+			want: `{"libraries": ["c"]}`,
+		},
+		{
+			name: "gerber layers replaced whole",
+			base: `{"grb": {"layers": ["F.Cu", "B.Cu"]}}`,
+			over: `{"grb": {"layers": ["In*.Cu"]}}`,
+			want: `{"grb": {"layers": ["In*.Cu"]}}`,
+		},
+		{
+			name: "object over a value",
+			base: `{"grb": true}`,
+			over: `{"grb": {"all": true}}`,
+			want: `{"grb": {"all": true}}`,
+		},
+		{
+			name: "check over its shorthand",
+			base: `{"drc": true}`,
+			over: `{"drc": {"fail": "warning"}}`,
+			want: `{"drc": {"fail": "warning"}}`,
+		},
+		{
+			name: "no base",
+			base: `null`,
+			over: `{"sch": true}`,
+			want: `{"sch": true}`,
+		},
+		{
+			name: "no over",
+			base: `{"sch": true}`,
+			over: `null`,
+			want: `{"sch": true}`,
+		},
+	}
+
+	for _, tt := range tests {
+		base := jsonTree(t, tt.base)
+		got := mergeTree(base, jsonTree(t, tt.over))
+		if want := jsonTree(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+		if want := jsonTree(t, tt.base); !reflect.DeepEqual(base, want) {
+			t.Errorf("%s: base changed to %v", tt.name, base)
+		}
+	}
+}
+
+func TestInheritSettings(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		settings string
+		want     string
+	}{
+		{
+			name:     "defaults under the project",
+			settings: `{"defaults": {"options": {"svg": true, "pcb": true}}, "projects": [{"main": "a", "options": {"svg": false}}]}`,
+			want:     `{"defaults": {"options": {"svg": true, "pcb": true}}, "projects": [{"main": "a", "options": {"svg": false, "pcb": true}}]}`,
+		},
+		{
+			name:     "project options under the variant",
+			settings: `{"projects": [{"main": "a", "options": {"svg": true, "grb": {"all": true}}, "variants": [{"name": "X"}, {"name": "Y", "options": {"grb": {"protel": true}}}]}]}`,
+			want:     `{"projects": [{"main": "a", "options": {"svg": true, "grb": {"all": true}}, "variants": [{"name": "X", "options": {"svg": true, "grb": {"all": true}}}, {"name": "Y", "options": {"svg": true, "grb": {"all": true, "protel": true}}}]}]}`,
+		},
+		{
+			name:     "null resets an inherited option",
+			settings: `{"projects": [{"main": "a", "options": {"svg": true, "pcb": true}, "variants": [{"name": "X", "options": {"pcb": null}}]}]}`,
+			want:     `{"projects": [{"main": "a", "options": {"svg": true, "pcb": true}, "variants": [{"name": "X", "options": {"svg": true}}]}]}`,
+		},
+		{
+			name:     "null options opt out",
+			settings: `{"projects": [{"main": "a", "options": {"svg": true}, "variants": [{"name": "X", "options": null}]}]}`,
+			want:     `{"projects": [{"main": "a", "options": {"svg": true}, "variants": [{"name": "X", "options": null}]}]}`,
+		},
+		{
+			name:     "schematic, BOM and ERC not inherited",
+			settings: `{"defaults": {"options": {"erc": true}}, "projects": [{"main": "a", "options": {"sch": true, "bom": true, "svg": true}, "variants": [{"name": "X"}, {"name": "Y", "options": {"bom": true}}]}]}`,
+			want:     `{"defaults": {"options": {"erc": true}}, "projects": [{"main": "a", "options": {"sch": true, "bom": true, "svg": true, "erc": true}, "variants": [{"name": "X", "options": {"svg": true}}, {"name": "Y", "options": {"svg": true, "bom": true}}]}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		got := inheritSettings(jsonTree(t, tt.settings))
+		if want := jsonTree(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+
+	restore := testEnv(map[string]string{
+		"PLUGIN_PROJECTS":    `[{"main": "board"}]`,
+		"PLUGIN_CREDENTIALS": `{"netrc": [{"machine": "git.example.com", "login": "ci", "password": "secret"}]}`,
+	})
+	defer restore()
+
+	var config Config
+	var problems []string
+	app := newApp()
+	app.Action = func(c *cli.Context) error {
+		problems = checkPluginEnv(c.App.Flags)
+		var err error
+		config, err = loadConfig(c, Build{})
+		return err
+	}
+	if err := app.Run([]string{"drone-kicad"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) > 0 {
+		t.Errorf("unknown settings: %q", problems)
+	}
+	want := []NetrcEntry{{Machine: "git.example.com", Login: "ci", Password: "secret"}}
+	if !reflect.DeepEqual(config.Credentials.Netrc, want) {
+		t.Errorf("credentials: got %+v, want %+v", config.Credentials.Netrc, want)
+	}
+
+	// Every JSON setting is read from its flag
+	for _, name := range jsonSettings {
+		found := false
+		for _, f := range app.Flags {
+			if f.GetName() == name && flagEnvVar(f) == "PLUGIN_"+strings.ToUpper(name) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: no flag read from PLUGIN_%s", name, strings.ToUpper(name))
+		}
+	}
+}
+
+func TestCheckVariantNames(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		projects []Project
+		problems []string
+	}{
+		{
+			name:     "distinct names",
+			projects: []Project{{Main: "a/board", Variants: []Variant{{Name: "X"}}}, {Main: "a/other"}},
+		},
+		{
+			name:     "project named after a variant",
+			projects: []Project{{Main: "a/board", Variants: []Variant{{Name: "X"}}}, {Main: "./a/board_X"}},
+			problems: []string{"projects[1].main: ./a/board_X has the same outputs as variant X of project a/board"},
+		},
+	}
+
+	for _, tt := range tests {
+		if problems := checkVariantNames(tt.projects); !sameProblems(problems, tt.problems) {
+			t.Errorf("%s: problems %q, want %q", tt.name, problems, tt.problems)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"options", "options", 0},
+		{"optons", "options", 1},
+		{"otpions", "options", 1},
+		{"", "sch", 3},
+		{"svg", "pcb", 3},
+	}
+
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
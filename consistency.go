@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// consistency compares the schematic symbols with the board footprints:
+// unannotated and duplicate references, references missing on either
+// side and footprints or values that differ. Variants rely on references
+// matching between both files.
+func consistency(project Project) []Finding {
+
+	sch := project.Main + ".sch"
+	brd := project.Main + ".kicad_pcb"
+	if _, err := os.Stat(sch); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(brd); err != nil {
+		return nil
+	}
+
+	var findings []Finding
+	seen := make(map[Finding]bool)
+	add := func(file string, line int, check string, format string, args ...interface{}) {
+		finding := Finding{File: file, Line: line, Check: check, Message: fmt.Sprintf(format, args...)}
+		if !seen[finding] {
+			seen[finding] = true
+			findings = append(findings, finding)
+		}
+	}
+
+	schematic, err := readSchematic(sch)
+	if err != nil {
+		add(sch, 0, "schematic", "%s", err)
+		return findings
+	}
+	board, err := readSexpr(brd)
+	if err != nil {
+		add(brd, 0, "board", "%s", err)
+		return findings
+	}
+
+	// Units of a symbol share its reference, other symbols must not
+	symbols := make(map[string]Component)
+	for _, c := range schematic.Components {
+		if c.IsPower() {
+			continue
+		}
+		if strings.HasSuffix(c.Ref, "?") {
+			add(c.File, c.Line, "unannotated", "%s: symbol %s is not annotated", c.Ref, c.Symbol)
+			continue
+		}
+		if other, ok := symbols[c.Ref]; ok {
+			if other.Unit == c.Unit || other.Symbol != c.Symbol {
+				add(c.File, c.Line, "duplicate-reference", "%s: also used at %s:%d", c.Ref, other.File, other.Line)
+			}
+			continue
+		}
+		symbols[c.Ref] = c
+	}
+
+	footprints := make(map[string]Footprint)
+	for _, fp := range boardFootprints(board) {
+		// REF** is the reference of footprints placed on the board
+		// alone, such as logos and mounting holes
+		if fp.BoardOnly || strings.HasSuffix(fp.Ref, "**") {
+			continue
+		}
+		if fp.Ref == "" || strings.HasSuffix(fp.Ref, "?") {
+			add(brd, fp.Line, "unannotated", "%s: footprint %s is not annotated", fp.Ref, fp.ID)
+			continue
+		}
+		if other, ok := footprints[fp.Ref]; ok {
+			add(brd, fp.Line, "duplicate-reference", "%s: also used at line %d", fp.Ref, other.Line)
+			continue
+		}
+		footprints[fp.Ref] = fp
+
+		c, ok := symbols[fp.Ref]
+		if !ok {
+			add(brd, fp.Line, "missing-in-schematic", "%s: footprint %s has no symbol in the schematic", fp.Ref, fp.ID)
+			continue
+		}
+		if c.Footprint != "" && !sameFootprint(c.Footprint, fp.ID) {
+			add(brd, fp.Line, "footprint-mismatch", "%s: footprint is %s, the schematic assigns %s", fp.Ref, fp.ID, c.Footprint)
+		}
+		if c.Value != fp.Value {
+			add(brd, fp.Line, "value-mismatch", "%s: value is %q, the schematic has %q", fp.Ref, fp.Value, c.Value)
+		}
+	}
+
+	for _, part := range schematic.Parts() {
+		if _, annotated := symbols[part.Ref]; !annotated {
+			continue
+		}
+		if _, ok := footprints[part.Ref]; !ok {
+			add(part.File, part.Line, "missing-on-board", "%s: symbol %s has no footprint on the board", part.Ref, part.Symbol)
+		}
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+// sameFootprint compares footprint identifiers, ignoring the library of
+// board footprints that lost it.
+func sameFootprint(sch string, brd string) bool {
+	if !strings.Contains(brd, ":") {
+		return sch[strings.Index(sch, ":")+1:] == brd
+	}
+	return sch == brd
+}
+
+// checkConsistency runs the consistency check of every project, adds the
+// findings to the results and returns an error listing them.
+func checkConsistency(projects []Project, results *Results) error {
+	var findings []Finding
+	for _, project := range projects {
+		findings = append(findings, consistency(project)...)
+	}
+	results.add(findings...)
+	return findingsError("schematic and board differ", findings)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConsistency(t *testing.T) {
+
+	module := func(ref string, value string) string {
+		return `  (module Resistor_SMD:R_0603 (layer F.Cu)
+    (fp_text reference "` + ref + `" (at 0 0) (layer F.SilkS))
+    (fp_text value "` + value + `" (at 0 0) (layer F.Fab))
+  )
+`
+	}
+	board := "(kicad_pcb (version 20171130)\n" +
+		module("R1", "10k") +
+		module("R2", "4k7") +
+		module("C1", "100n") +
+		module("REF**", "Logo") +
+		module("H1**", "MountingHole") +
+		module("R?", "1k") +
+		")\n"
+
+	dir, remove := testDir(t, map[string]string{"a/a.sch": testSchematic, "a/a.kicad_pcb": board})
+	defer remove()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+
+	var got []string
+	for _, finding := range consistency(Project{Main: "a/a"}) {
+		got = append(got, finding.Check+": "+finding.Message)
+	}
+	want := []string{
+		`value-mismatch: R2: value is "4k7", the schematic has "1k"`,
+		`unannotated: R?: footprint Resistor_SMD:R_0603 is not annotated`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
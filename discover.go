@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// sidecarSuffix names the per-project override file of discovered
+// projects: <project>.drone-kicad.json next to the project file
+const sidecarSuffix = ".drone-kicad.json"
+
+var (
+	defaultInclude = []string{"**/*.pro", "**/*.kicad_pro"}
+	defaultExclude = []string{"CI-BUILD/**"}
+)
+
+// Discover defines how projects are found in the workspace
+type Discover struct {
+	Include  []string `json:"include"`  // Project file globs, **/*.pro and **/*.kicad_pro by default
+	Exclude  []string `json:"exclude"`  // Globs of project files to skip
+	Template Defaults `json:"template"` // Settings of every discovered project
+}
+
+// discoverProjects adds a project for every project file matching the
+// discover settings. A sidecar file next to the project file overrides
+// the template for that project. Projects already listed by hand are
+// left as they are.
+func discoverProjects(tree interface{}, problems *[]string) interface{} {
+
+	settings, ok := tree.(map[string]interface{})
+	if !ok {
+		return tree
+	}
+	d, ok := settings["discover"]
+	if !ok || d == nil {
+		return tree
+	}
+
+	var discover Discover
+	if err := decodeTree(d, &discover); err != nil {
+		*problems = append(*problems, fmt.Sprintf("discover: %s", err))
+		return tree
+	}
+	if len(discover.Include) == 0 {
+		discover.Include = defaultInclude
+	}
+	discover.Exclude = append(discover.Exclude, defaultExclude...)
+
+	files, err := findFiles(".", discover.Include, discover.Exclude)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("discover: %s", err))
+		return tree
+	}
+
+	projects, _ := settings["projects"].([]interface{})
+	listed := make(map[string]bool)
+	for _, p := range projects {
+		if project, ok := p.(map[string]interface{}); ok {
+			if main, ok := project["main"].(string); ok {
+				listed[path.Clean(main)] = true
+			}
+		}
+	}
+
+	template, _ := d.(map[string]interface{})["template"]
+	for _, file := range files {
+		main := strings.TrimSuffix(file, path.Ext(file))
+		if listed[main] {
+			continue
+		}
+
+		// Only KiCad 5 schematics are read: a KiCad 6 project without a
+		// .sch file can't be built, unless a .pro file stands for it
+		if path.Ext(file) == ".kicad_pro" {
+			if _, err := os.Stat(main + ".sch"); os.IsNotExist(err) {
+				if _, err := os.Stat(main + ".pro"); os.IsNotExist(err) {
+					fmt.Printf("warning: skipped project %s: KiCad 6 projects are not supported, no %s.sch\n", main, main)
+				}
+				continue
+			}
+		}
+		listed[main] = true
+
+		project := mergeTree(template, map[string]interface{}{"main": main})
+
+		sidecar := main + sidecarSuffix
+		if data, err := ioutil.ReadFile(sidecar); err == nil {
+			var value interface{}
+			if err := json.Unmarshal(data, &value); err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s: %s", sidecar, err))
+				continue
+			}
+			object, ok := value.(map[string]interface{})
+			if ok && object["main"] != nil {
+				*problems = append(*problems, fmt.Sprintf("%s: main: set by the project file location", sidecar))
+				continue
+			}
+			// Keys are folded before the merge, so that "Options" is
+			// merged over the "options" of the template
+			if ok {
+				object["main"] = main
+			}
+			project = mergeTree(project, normalizeTree(sidecar, value, reflect.TypeOf(Project{}), problems))
+		} else if !os.IsNotExist(err) {
+			*problems = append(*problems, err.Error())
+			continue
+		}
+
+		fmt.Printf("discovered project %s\n", main)
+		projects = append(projects, project)
+	}
+	settings["projects"] = projects
+
+	return settings
+}
+
+// findFiles walks root and returns the files matching one of the include
+// globs and none of the exclude globs, relative to root and sorted.
+func findFiles(root string, include []string, exclude []string) ([]string, error) {
+
+	var files []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchAny(include, rel) && !matchAny(exclude, rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+
+	return files, err
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash separated path against a glob where `**`
+// stands for any number of directories. Patterns without a slash match
+// the base name, as in .gitignore files.
+func matchGlob(pattern string, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
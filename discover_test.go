@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.pro", "board.pro", true},
+		{"*.pro", "boards/psu/psu.pro", true},
+		{"*.pro", "boards/psu/psu.sch", false},
+		{"**/*.pro", "board.pro", true},
+		{"**/*.pro", "boards/psu/psu.pro", true},
+		{"boards/*.pro", "boards/psu.pro", true},
+		{"boards/*.pro", "boards/psu/psu.pro", false},
+		{"boards/**/*.pro", "boards/psu.pro", true},
+		{"boards/**/*.pro", "boards/a/b/psu.pro", true},
+		{"boards/**", "boards/a/b/psu.pro", true},
+		{"boards/**", "other/psu.pro", false},
+		{"CI-BUILD/**", "CI-BUILD/board/board.pro", true},
+		{"boards/archive/**", "boards/psu/psu.pro", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+
+	dir, remove := testDir(t, map[string]string{
+		"top.pro":                     "",
+		"boards/psu/psu.pro":          "",
+		"boards/psu/psu.sch":          "",
+		"boards/archive/old/old.pro":  "",
+		"CI-BUILD/psu/psu.pro":        "",
+		".git/modules/lib/lib.pro":    "",
+		"boards/io/io.pro":            "",
+		"boards/io/io.drone-kicad.js": "",
+	})
+	defer remove()
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:    "everywhere",
+			include: []string{"**/*.pro"},
+			want:    []string{"CI-BUILD/psu/psu.pro", "boards/archive/old/old.pro", "boards/io/io.pro", "boards/psu/psu.pro", "top.pro"},
+		},
+		{
+			name:    "excluded directories",
+			include: []string{"**/*.pro"},
+			exclude: []string{"boards/archive/**", "CI-BUILD/**"},
+			want:    []string{"boards/io/io.pro", "boards/psu/psu.pro", "top.pro"},
+		},
+		{
+			name:    "one directory",
+			include: []string{"boards/*/*.pro"},
+			want:    []string{"boards/io/io.pro", "boards/psu/psu.pro"},
+		},
+		{
+			name:    "excluded by name",
+			include: []string{"*.pro"},
+			exclude: []string{"old.pro", "CI-BUILD/**"},
+			want:    []string{"boards/io/io.pro", "boards/psu/psu.pro", "top.pro"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := findFiles(dir, tt.include, tt.exclude)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiscoverProjects(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		settings string
+		want     string
+		problems []string
+	}{
+		{
+			name:     "template applied",
+			files:    map[string]string{"a/a.pro": "", "b/b.pro": ""},
+			settings: `{"discover": {"include": ["**/*.pro"], "template": {"options": {"sch": true}}}}`,
+			want: `{"discover": {"include": ["**/*.pro"], "template": {"options": {"sch": true}}}, "projects": [
+				{"main": "a/a", "options": {"sch": true}},
+				{"main": "b/b", "options": {"sch": true}}
+			]}`,
+		},
+		{
+			name:     "listed projects kept",
+			files:    map[string]string{"a/a.pro": "", "b/b.pro": ""},
+			settings: `{"projects": [{"main": "./a/a", "options": {"svg": true}}], "discover": {"include": ["**/*.pro"]}}`,
+			want: `{"discover": {"include": ["**/*.pro"]}, "projects": [
+				{"main": "./a/a", "options": {"svg": true}},
+				{"main": "b/b"}
+			]}`,
+		},
+		{
+			name: "default include",
+			files: map[string]string{
+				"a/a.pro":       "",
+				"b/b.pro":       "",
+				"b/b.kicad_pro": "",
+				"c/c.kicad_pro": "",
+				"c/c.sch":       "",
+				"d/d.kicad_pro": "",
+				"d/d.kicad_sch": "",
+			},
+			settings: `{"discover": {}}`,
+			want: `{"discover": {}, "projects": [
+				{"main": "a/a"},
+				{"main": "b/b"},
+				{"main": "c/c"}
+			]}`,
+		},
+		{
+			name: "sidecar over the template",
+			files: map[string]string{
+				"a/a.pro":              "",
+				"a/a.drone-kicad.json": `{"Options": {"SCH": false, "svg": true}}`,
+			},
+			settings: `{"discover": {"include": ["**/*.pro"], "template": {"options": {"sch": true, "bom": true}}}}`,
+			want: `{"discover": {"include": ["**/*.pro"], "template": {"options": {"sch": true, "bom": true}}}, "projects": [
+				{"main": "a/a", "options": {"sch": false, "bom": true, "svg": true}}
+			]}`,
+		},
+		{
+			name: "sidecar setting main",
+			files: map[string]string{
+				"a/a.pro":              "",
+				"a/a.drone-kicad.json": `{"main": "b"}`,
+			},
+			settings: `{"discover": {"include": ["**/*.pro"]}}`,
+			problems: []string{"a/a.drone-kicad.json: main: set by the project file location"},
+		},
+		{
+			name: "sidecar with an unknown key",
+			files: map[string]string{
+				"a/a.pro":              "",
+				"a/a.drone-kicad.json": `{"optons": {}}`,
+			},
+			settings: `{"discover": {"include": ["**/*.pro"]}}`,
+			problems: []string{`a/a.drone-kicad.json.optons: unknown key, did you mean "options"?`},
+		},
+	}
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	for _, tt := range tests {
+		dir, remove := testDir(t, tt.files)
+		os.Chdir(dir)
+
+		var problems []string
+		got := discoverProjects(jsonTree(t, tt.settings), &problems)
+
+		os.Chdir(cwd)
+		remove()
+
+		if len(tt.problems) > 0 || len(problems) > 0 {
+			if !sameProblems(problems, tt.problems) {
+				t.Errorf("%s: problems %q, want %q", tt.name, problems, tt.problems)
+			}
+			continue
+		}
+		if want := jsonTree(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Violation severities, from the least to the most severe
+const (
+	SEVERITY_WARNING = "warning"
+	SEVERITY_ERROR   = "error"
+	SEVERITY_NEVER   = "never" // Only as a threshold: nothing fails the build
+)
+
+// Rule checks
+const (
+	CHECK_DRC = "drc"
+	CHECK_ERC = "erc"
+)
+
+// Violation is a problem reported by the KiCad design or electrical rule
+// check
+type Violation struct {
+	Rule     string   `json:"rule"`            // KiCad error code, e.g. clearance or ErrType(45)
+	Severity string   `json:"severity"`        // error or warning
+	Message  string   `json:"message"`         // Description of the rule
+	Sheet    string   `json:"sheet,omitempty"` // Sheet path, for the ERC
+	Items    []string `json:"items"`           // Items involved, with their position
+}
+
+var violationHeader = regexp.MustCompile(`^(ErrType\(\d+\)):\s*(.*)$`)
+
+// parseReport reads the violations of a KiCad 5 DRC or ERC report. The
+// reports carry no severity, every violation is an error.
+func parseReport(text string) []Violation {
+
+	violations := []Violation{}
+	var current *Violation
+	var sheet string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "***** Sheet "):
+			sheet = strings.TrimPrefix(trimmed, "***** Sheet ")
+			current = nil
+		case strings.HasPrefix(trimmed, "**"):
+			current = nil
+		case violationHeader.MatchString(trimmed):
+			m := violationHeader.FindStringSubmatch(trimmed)
+			violations = append(violations, Violation{
+				Rule:     m[1],
+				Severity: SEVERITY_ERROR,
+				Message:  m[2],
+				Sheet:    sheet,
+			})
+			current = &violations[len(violations)-1]
+		case current == nil:
+		case strings.HasPrefix(trimmed, "@"):
+			current.Items = append(current.Items, trimmed)
+		}
+	}
+
+	return violations
+}
+
+// severityRank orders severities, higher is more severe.
+func severityRank(severity string) int {
+	switch severity {
+	case SEVERITY_WARNING:
+		return 1
+	case SEVERITY_ERROR:
+		return 2
+	case SEVERITY_NEVER:
+		return 3
+	}
+	return 0
+}
+
+// threshold returns the lowest severity failing the build.
+func (c Check) threshold() string {
+	if c.Fail == "" {
+		return SEVERITY_ERROR
+	}
+	return c.Fail
+}
+
+// failing returns the violations at or above the failure threshold of a
+// check.
+func (c Check) failing(violations []Violation) []Violation {
+	var failing []Violation
+	for _, v := range violations {
+		if severityRank(v.Severity) >= severityRank(c.threshold()) {
+			failing = append(failing, v)
+		}
+	}
+	return failing
+}
+
+// checkReport parses the report of a check on source, writes its
+// violations as JSON next to it, prints them and adds them to the results.
+// Violations of the baseline are accepted, and fixed ones reported as
+// resolved. The check fails if more new violations than allowed reach the
+// threshold.
+func checkReport(kind string, check Check, source string, report string, accepted []Violation, results *Results) error {
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		return fmt.Errorf("%s report: %s", kind, err)
+	}
+	violations := parseReport(string(data))
+
+	out, err := json.MarshalIndent(violations, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(strings.TrimSuffix(report, path.Ext(report))+".json", append(out, '\n'), 0644); err != nil {
+		return err
+	}
+
+	fresh, resolved := compareBaseline(accepted, violations)
+	state := ""
+	if len(accepted) > 0 {
+		state = "new"
+	}
+	// Violations below the threshold, or all of them when tolerated, are
+	// reported without failing
+	failing := check.failing(fresh)
+	findings := violationFindings(kind, source, fresh, state)
+	for i, v := range fresh {
+		findings[i].Passing = len(failing) <= check.Allow || severityRank(v.Severity) < severityRank(check.threshold())
+	}
+	results.add(findings...)
+	unchanged, _ := compareBaseline(fresh, violations)
+	results.add(violationFindings(kind, source, unchanged, "unchanged")...)
+	results.add(violationFindings(kind, source, resolved, "absent")...)
+	counts := make(map[string]int)
+	for _, v := range fresh {
+		counts[v.Severity]++
+		fmt.Printf("%s %s: %s\n", strings.ToUpper(kind), v.Severity, violationText(v))
+	}
+	for _, v := range resolved {
+		fmt.Printf("%s resolved: %s\n", strings.ToUpper(kind), violationText(v))
+	}
+	fmt.Printf("%s: %d new errors, %d new warnings, %d baselined, %d resolved\n", report,
+		counts[SEVERITY_ERROR], counts[SEVERITY_WARNING], len(violations)-len(fresh), len(resolved))
+	if len(resolved) > 0 {
+		fmt.Printf("run drone-kicad baseline to remove the resolved violations from %s\n", baselineFile)
+	}
+
+	if len(failing) > check.Allow {
+		return fmt.Errorf("%s failed: %d new violations at or above %s, %d allowed, see %s",
+			strings.ToUpper(kind), len(failing), check.threshold(), check.Allow, report)
+	}
+	return nil
+}
+
+// violationText formats a violation on one line.
+func violationText(v Violation) string {
+	text := fmt.Sprintf("[%s] %s", v.Rule, v.Message)
+	if v.Sheet != "" {
+		text += " in sheet " + v.Sheet
+	}
+	if len(v.Items) > 0 {
+		text += " " + strings.Join(v.Items, "; ")
+	}
+	return text
+}
+
+// checkSeverity returns what is wrong with the threshold of a check, or "".
+func checkSeverity(check Check) string {
+	switch check.Fail {
+	case "", SEVERITY_ERROR, SEVERITY_WARNING, SEVERITY_NEVER:
+		return ""
+	}
+	return fmt.Sprintf("fail: %q is not one of %s, %s, %s", check.Fail, SEVERITY_ERROR, SEVERITY_WARNING, SEVERITY_NEVER)
+}
+
+func commandDRC(pjtname string, variant string, report string, wait int) *exec.Cmd {
+
+	board := pjtname + ".kicad_pcb"
+	if len(variant) > 0 {
+		board = pjtname + "_" + variant + ".kicad_pcb"
+	}
+
+	var options []string
+	options = append(options, "-u", drc_script, "--brd", board, "--report", report)
+	if wait > 0 {
+		options = append(options, "--wait_init", strconv.Itoa(wait))
+	}
+	var c = exec.Command(
+		pythonexec,
+		options...,
+	)
+
+	c.Env = os.Environ()
+	c.Env = append(c.Env, "DEBIAN_FRONTEND=noninteractive")
+	c.Env = append(c.Env, "DISPLAY=:0")
+
+	return c
+}
+
+func commandERC(schname string, report string, wait int) *exec.Cmd {
+
+	var options []string
+	options = append(options, "-u", erc_script, "--sch", schname+".sch", "--report", report)
+	if wait > 0 {
+		options = append(options, "--wait_init", strconv.Itoa(wait))
+	}
+	var c = exec.Command(
+		pythonexec,
+		options...,
+	)
+
+	c.Env = os.Environ()
+	c.Env = append(c.Env, "DEBIAN_FRONTEND=noninteractive")
+	c.Env = append(c.Env, "DISPLAY=:0")
+
+	return c
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReport(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		report string
+		want   []Violation
+	}{
+		{
+			name: "DRC",
+			report: `** Drc report for /drone/src/board.kicad_pcb **
+** Created on 2020-05-04 10:12:31 **
+
+** Found 2 DRC errors **
+ErrType(45): Courtyards overlap
+    @(144.000 mm, 91.000 mm): Footprint C1 on F.Cu
+    @(146.000 mm, 91.000 mm): Footprint R1 on F.Cu
+ErrType(2): Track too close to pad
+    @(120.500 mm, 80.250 mm): Track 0.2540 mm on F.Cu, length 1.2700 mm
+    @(121.000 mm, 80.000 mm): Pad 1 of R1 on F.Cu and others
+
+** Found 1 unconnected pads **
+ErrType(1): Unconnected items
+    @(100.000 mm, 50.000 mm): Pad 2 of C1 on F.Cu
+    @(110.000 mm, 50.000 mm): Pad 1 of R2 on F.Cu
+
+** End of Report **
+`,
+			want: []Violation{
+				{Rule: "ErrType(45)", Severity: SEVERITY_ERROR, Message: "Courtyards overlap", Items: []string{
+					"@(144.000 mm, 91.000 mm): Footprint C1 on F.Cu",
+					"@(146.000 mm, 91.000 mm): Footprint R1 on F.Cu",
+				}},
+				{Rule: "ErrType(2)", Severity: SEVERITY_ERROR, Message: "Track too close to pad", Items: []string{
+					"@(120.500 mm, 80.250 mm): Track 0.2540 mm on F.Cu, length 1.2700 mm",
+					"@(121.000 mm, 80.000 mm): Pad 1 of R1 on F.Cu and others",
+				}},
+				{Rule: "ErrType(1)", Severity: SEVERITY_ERROR, Message: "Unconnected items", Items: []string{
+					"@(100.000 mm, 50.000 mm): Pad 2 of C1 on F.Cu",
+					"@(110.000 mm, 50.000 mm): Pad 1 of R2 on F.Cu",
+				}},
+			},
+		},
+		{
+			name: "ERC",
+			report: `ERC report (2020-05-04 10:12:31, Encoding UTF8 )
+
+***** Sheet /
+ErrType(3): Pin not connected (use a "no connection" flag to suppress this error)
+    @ (50.80 mm, 76.20 mm): Component U1, pin 4 (input)
+
+***** Sheet /power/
+ErrType(2): Pin connected to some others pins but no pin to drive it
+    @ (101.60 mm, 63.50 mm): Component U2, pin 1 (power input)
+
+ ** ERC messages: 2  Errors 2  Warnings 0
+`,
+			want: []Violation{
+				{Rule: "ErrType(3)", Severity: SEVERITY_ERROR, Message: `Pin not connected (use a "no connection" flag to suppress this error)`, Sheet: "/", Items: []string{
+					"@ (50.80 mm, 76.20 mm): Component U1, pin 4 (input)",
+				}},
+				{Rule: "ErrType(2)", Severity: SEVERITY_ERROR, Message: "Pin connected to some others pins but no pin to drive it", Sheet: "/power/", Items: []string{
+					"@ (101.60 mm, 63.50 mm): Component U2, pin 1 (power input)",
+				}},
+			},
+		},
+		{
+			name:   "clean",
+			report: "** Drc report for board.kicad_pcb **\n\n** Found 0 DRC errors **\n\n** Found 0 unconnected pads **\n\n** End of Report **\n",
+			want:   []Violation{},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := parseReport(tt.report); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fabEpsilon absorbs the rounding of board coordinates, in millimetres
+const fabEpsilon = 1e-6
+
+// designRule is a minimum the board design rules set
+type designRule struct {
+	Kind  string  // track, space, drill or annular
+	Name  string  // Rule name in the file
+	Value float64 // Millimetres
+	File  string
+	Line  int
+}
+
+// boardRules returns the minimums of the design rules of a board: KiCad 5
+// keeps them in the board setup and net classes, KiCad 6 in the project
+// file, shared by the variant boards.
+func boardRules(project Project, brd string, board *Node) []designRule {
+
+	var rules []designRule
+	add := func(kind string, name string, value float64, file string, line int) {
+		if value > 0 {
+			rules = append(rules, designRule{kind, name, value, file, line})
+		}
+	}
+	number := func(n *Node, name string) (float64, int) {
+		child := n.Child(name)
+		if child == nil {
+			return 0, 0
+		}
+		value, _ := strconv.ParseFloat(child.Arg(0), 64)
+		return value, child.Line
+	}
+
+	if setup := board.Child("setup"); setup != nil {
+		for name, kind := range map[string]string{"trace_min": "track", "trace_clearance": "space", "via_min_drill": "drill"} {
+			value, line := number(setup, name)
+			add(kind, name, value, brd, line)
+		}
+	}
+	for _, class := range board.Children("net_class") {
+		at := "net class " + class.Arg(0) + " "
+		width, line := number(class, "trace_width")
+		add("track", at+"trace_width", width, brd, line)
+		clearance, line := number(class, "clearance")
+		add("space", at+"clearance", clearance, brd, line)
+		dia, _ := number(class, "via_dia")
+		drill, line := number(class, "via_drill")
+		add("drill", at+"via_drill", drill, brd, line)
+		if dia > 0 && drill > 0 {
+			add("annular", at+"via annular ring", round((dia-drill)/2), brd, line)
+		}
+	}
+
+	pro := project.Main + ".kicad_pro"
+	data, err := ioutil.ReadFile(pro)
+	if err != nil {
+		return rules
+	}
+	var settings struct {
+		Board struct {
+			DesignSettings struct {
+				Rules map[string]interface{} `json:"rules"`
+			} `json:"design_settings"`
+		} `json:"board"`
+		NetSettings struct {
+			Classes []struct {
+				Name        string  `json:"name"`
+				Clearance   float64 `json:"clearance"`
+				TrackWidth  float64 `json:"track_width"`
+				ViaDiameter float64 `json:"via_diameter"`
+				ViaDrill    float64 `json:"via_drill"`
+			} `json:"classes"`
+		} `json:"net_settings"`
+	}
+	if json.Unmarshal(data, &settings) != nil {
+		return rules
+	}
+	for name, kind := range map[string]string{
+		"min_track_width":           "track",
+		"min_clearance":             "space",
+		"min_through_hole_diameter": "drill",
+		"min_via_annular_width":     "annular",
+	} {
+		if value, ok := settings.Board.DesignSettings.Rules[name].(float64); ok {
+			add(kind, name, value, pro, 0)
+		}
+	}
+	for _, class := range settings.NetSettings.Classes {
+		at := "net class " + class.Name + " "
+		add("track", at+"track_width", class.TrackWidth, pro, 0)
+		add("space", at+"clearance", class.Clearance, pro, 0)
+		add("drill", at+"via_drill", class.ViaDrill, pro, 0)
+		if class.ViaDiameter > 0 && class.ViaDrill > 0 {
+			add("annular", at+"via annular ring", round((class.ViaDiameter-class.ViaDrill)/2), pro, 0)
+		}
+	}
+
+	return rules
+}
+
+// smallest keeps the smallest value below a fab minimum, and how many are
+type smallest struct {
+	Value float64
+	Line  int
+	Count int
+}
+
+func (s *smallest) add(value float64, min float64, line int) {
+	if min <= 0 || value <= 0 || value >= min-fabEpsilon {
+		return
+	}
+	if s.Count == 0 || value < s.Value {
+		s.Value, s.Line = value, line
+	}
+	s.Count++
+}
+
+// boardOutline returns the size of the Edge.Cuts drawings of a board.
+// Arcs count by their end points.
+func boardOutline(board *Node) (float64, float64, bool) {
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	point := func(x, y float64) {
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	xy := func(n *Node) (float64, float64, bool) {
+		if n == nil {
+			return 0, 0, false
+		}
+		x, errX := strconv.ParseFloat(n.Arg(0), 64)
+		y, errY := strconv.ParseFloat(n.Arg(1), 64)
+		return x, y, errX == nil && errY == nil
+	}
+
+	for _, n := range board.List {
+		if !strings.HasPrefix(n.Name(), "gr_") || n.Child("layer") == nil || n.Child("layer").Arg(0) != "Edge.Cuts" {
+			continue
+		}
+		if n.Name() == "gr_circle" {
+			cx, cy, ok := xy(n.Child("center"))
+			ex, ey, ok2 := xy(n.Child("end"))
+			if ok && ok2 {
+				r := math.Hypot(ex-cx, ey-cy)
+				point(cx-r, cy-r)
+				point(cx+r, cy+r)
+			}
+			continue
+		}
+		for _, name := range []string{"start", "mid", "end"} {
+			if x, y, ok := xy(n.Child(name)); ok {
+				point(x, y)
+			}
+		}
+		if pts := n.Child("pts"); pts != nil {
+			for _, p := range pts.Children("xy") {
+				if x, y, ok := xy(p); ok {
+					point(x, y)
+				}
+			}
+		}
+	}
+
+	if minX > maxX {
+		return 0, 0, false
+	}
+	return maxX - minX, maxY - minY, true
+}
+
+// copperLayers counts the copper layers enabled on a board.
+func copperLayers(board *Node) int {
+	count := 0
+	if layers := board.Child("layers"); layers != nil {
+		for _, layer := range layers.List[1:] {
+			if layer.IsList && strings.HasSuffix(layer.Arg(0), ".Cu") {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// fabFindings checks the design rules and the geometry of a board of a
+// project, its own or a variant's, against the capabilities of a fab.
+func fabFindings(project Project, brd string, name string, fab Fab) []Finding {
+
+	if _, err := os.Stat(brd); err != nil {
+		return nil
+	}
+	board, err := readSexpr(brd)
+	if err != nil {
+		return []Finding{{File: brd, Check: "board", Message: err.Error()}}
+	}
+
+	var findings []Finding
+	add := func(file string, line int, check string, format string, args ...interface{}) {
+		findings = append(findings, Finding{File: file, Line: line, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	minimum := map[string]float64{"track": fab.Track, "space": fab.Space, "drill": fab.Drill, "annular": fab.Annular}
+	checks := map[string]string{"track": "track-width", "space": "clearance", "drill": "drill-size", "annular": "annular-ring"}
+	for _, rule := range boardRules(project, brd, board) {
+		if min := minimum[rule.Kind]; min > 0 && rule.Value < min-fabEpsilon {
+			add(rule.File, rule.Line, checks[rule.Kind], "design rule %s is %g mm, %s needs at least %g mm", rule.Name, rule.Value, name, min)
+		}
+	}
+
+	size := func(n *Node, key string) float64 {
+		child := n.Child(key)
+		if child == nil {
+			return 0
+		}
+		// Oval drills are written (drill oval x y)
+		args := child.List[1:]
+		if len(args) > 0 && args[0].Atom == "oval" {
+			args = args[1:]
+		}
+		value := 0.0
+		for _, arg := range args {
+			if v, err := strconv.ParseFloat(arg.Atom, 64); err == nil && !arg.IsList && (value == 0 || v < value) {
+				value = v
+			}
+		}
+		return value
+	}
+
+	var tracks, drills, rings smallest
+	for _, n := range board.List {
+		switch n.Name() {
+		case "segment", "arc":
+			tracks.add(size(n, "width"), fab.Track, n.Line)
+		case "via":
+			if hasAtom(n, "micro") {
+				continue
+			}
+			drill := size(n, "drill")
+			drills.add(drill, fab.Drill, n.Line)
+			rings.add(round((size(n, "size")-drill)/2), fab.Annular, n.Line)
+		}
+	}
+	for _, fp := range boardFootprints(board) {
+		for _, pad := range fp.Node.Children("pad") {
+			kind := pad.Arg(1)
+			if kind != "thru_hole" && kind != "np_thru_hole" {
+				continue
+			}
+			drill := size(pad, "drill")
+			drills.add(drill, fab.Drill, pad.Line)
+			if kind == "thru_hole" {
+				rings.add(round((size(pad, "size")-drill)/2), fab.Annular, pad.Line)
+			}
+		}
+	}
+	if tracks.Count > 0 {
+		add(brd, tracks.Line, "track-width", "the narrowest track is %g mm, %d below the %s minimum of %g mm", tracks.Value, tracks.Count, name, fab.Track)
+	}
+	if drills.Count > 0 {
+		add(brd, drills.Line, "drill-size", "the smallest hole is %g mm, %d below the %s minimum of %g mm", drills.Value, drills.Count, name, fab.Drill)
+	}
+	if rings.Count > 0 {
+		add(brd, rings.Line, "annular-ring", "the smallest annular ring is %g mm, %d below the %s minimum of %g mm", rings.Value, rings.Count, name, fab.Annular)
+	}
+
+	if width, height, ok := boardOutline(board); ok && fab.Width > 0 && fab.Height > 0 {
+		fits := func(w, h float64) bool { return w <= fab.Width+fabEpsilon && h <= fab.Height+fabEpsilon }
+		if !fits(width, height) && !fits(height, width) {
+			add(brd, 0, "board-size", "board is %g x %g mm, %s makes at most %g x %g mm", round(width), round(height), name, fab.Width, fab.Height)
+		}
+	}
+	if layers := copperLayers(board); fab.Layers > 0 && layers > fab.Layers {
+		add(brd, 0, "layer-count", "board has %d copper layers, %s makes at most %d", layers, name, fab.Layers)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+func hasAtom(n *Node, atom string) bool {
+	for _, item := range n.List {
+		if !item.IsList && item.Atom == atom {
+			return true
+		}
+	}
+	return false
+}
+
+// round rounds millimetres to the micrometre.
+func round(mm float64) float64 {
+	return math.Round(mm*1000) / 1000
+}
+
+// checkFabs checks the board of every project against the fab it is made
+// by, adds the findings to the results and returns an error listing them.
+// Variant boards only exist once built, they are checked by a step.
+func checkFabs(projects []Project, fabs map[string]Fab, results *Results) error {
+	var findings []Finding
+	for _, project := range projects {
+		if name := project.Options.Fab; name != "" {
+			findings = append(findings, fabFindings(project, project.Main+".kicad_pcb", name, fabs[name])...)
+		}
+	}
+	results.add(findings...)
+	return findingsError("board exceeds the fab capabilities", findings)
+}
+
+// checkVariantFab checks the board of a variant against the fab it is made
+// by, once built.
+func checkVariantFab(project Project, variant Variant, fabs map[string]Fab, results *Results) error {
+	name := variant.Options.Fab
+	findings := fabFindings(project, project.Main+"_"+variant.Name+".kicad_pcb", name, fabs[name])
+	results.add(findings...)
+	return findingsError("variant board exceeds the fab capabilities", findings)
+}
+
+// applyFabGerbers fills in the gerber options of the projects and variants
+// made by a fab with the ones it expects. Options set in the configuration
+// are kept.
+func applyFabGerbers(tree interface{}) interface{} {
+
+	settings, ok := tree.(map[string]interface{})
+	if !ok {
+		return tree
+	}
+	fabs, _ := settings["fabs"].(map[string]interface{})
+	apply := func(options interface{}) {
+		object, _ := options.(map[string]interface{})
+		name, _ := object["fab"].(string)
+		fab, ok := fabs[name].(map[string]interface{})
+		if !ok {
+			return
+		}
+		grb, ok := object["grb"].(map[string]interface{})
+		if !ok {
+			grb = make(map[string]interface{})
+			object["grb"] = grb
+		}
+		for _, key := range []string{"protel", "splitth"} {
+			if _, set := grb[key]; !set {
+				if value, ok := fab[key]; ok {
+					grb[key] = value
+				}
+			}
+		}
+	}
+
+	projects, _ := settings["projects"].([]interface{})
+	for _, p := range projects {
+		project, _ := p.(map[string]interface{})
+		apply(project["options"])
+		variants, _ := project["variants"].([]interface{})
+		for _, v := range variants {
+			variant, _ := v.(map[string]interface{})
+			apply(variant["options"])
+		}
+	}
+
+	return settings
+}
+
+// checkFab returns what is wrong with a fab definition.
+func checkFab(fab Fab) []string {
+	var problems []string
+	for key, value := range map[string]float64{
+		"track": fab.Track, "space": fab.Space, "drill": fab.Drill, "annular": fab.Annular,
+		"width": fab.Width, "height": fab.Height, "layers": float64(fab.Layers),
+	} {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative", key))
+		}
+	}
+	return problems
+}
+
+func unknownFab(at string, name string, known []string) string {
+	if s := suggest(name, known); s != "" {
+		return fmt.Sprintf("%s: unknown fab %q, did you mean %q?", at, name, s)
+	}
+	return fmt.Sprintf("%s: unknown fab %q (expected one of: %s)", at, name, strings.Join(known, ", "))
+}
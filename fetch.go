@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fetch defines how dependencies are fetched
+type Fetch struct {
+	Cache   string // Directory keeping a mirror of each repository between builds
+	Jobs    int    // Repositories fetched at once
+	Shallow bool   // Fetch only the checked out commit
+	Only    bool   // Fetch the dependencies and stop
+}
+
+// fetchJob is a dependency checkout, shared by every project using the
+// same directory
+type fetchJob struct {
+	Dependency
+	Type   int    // DEP_TYPE_*
+	Dir    string // Checkout directory
+	Commit string // Locked commit, the ref is used if empty
+}
+
+var unsafeChars = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+// dependencyDir returns the directory a dependency of the given type is
+// checked out in.
+func dependencyDir(dep Dependency, deptype int, basedir string) string {
+
+	if deptype == DEP_TYPE_LIB {
+		basedir = path.Join(basedir, "library")
+	} else if deptype == DEP_TYPE_PRETTY {
+		basedir = path.Join(basedir, "footprints")
+	} else if deptype == DEP_TYPE_3D {
+		basedir = path.Join(basedir, "modules/packages3d")
+	} else if deptype == DEP_TYPE_TEMPLATE {
+		basedir = path.Join(basedir, "template")
+	} else if deptype == DEP_TYPE_SVG {
+		basedir = path.Join(basedir, "svg-lib")
+	}
+
+	return path.Join(basedir, dep.name())
+}
+
+// fetchJobs lists the checkouts the projects need, once per directory. A
+// directory wanted at two different repositories or commits is an error.
+func fetchJobs(projects []Project, lock map[string]string) ([]fetchJob, error) {
+
+	byDir := make(map[string]fetchJob)
+	var problems []string
+	for _, project := range projects {
+		basedir := project.Dependencies.Basedir
+		if basedir == "" {
+			basedir = "/usr/share/kicad"
+		}
+		for _, dep := range project.Dependencies.list() {
+			job := fetchJob{
+				Dependency: dep.Dependency,
+				Type:       dep.Type,
+				Dir:        dependencyDir(dep.Dependency, dep.Type, basedir),
+				Commit:     lock[dep.key()],
+			}
+			if other, ok := byDir[job.Dir]; ok {
+				if other.URL != job.URL || other.Commit != job.Commit || other.Sha256 != job.Sha256 || (job.Commit == "" && other.Ref != job.Ref) {
+					problems = append(problems, fmt.Sprintf("%s: wanted both as %s and as %s", job.Dir, other.key(), job.key()))
+				}
+				continue
+			}
+			byDir[job.Dir] = job
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("conflicting dependencies:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	var jobs []fetchJob
+	for _, job := range byDir {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Dir < jobs[j].Dir })
+
+	return jobs, nil
+}
+
+// fetchDependencies updates the mirrors of the cache, if any, then checks
+// out, links or extracts every dependency, up to Jobs at once. Existing
+// checkouts are updated in place.
+func fetchDependencies(jobs []fetchJob, fetch Fetch) error {
+
+	mirrors := make(map[string]string)
+	if fetch.Cache != "" {
+		var urls []string
+		for _, job := range jobs {
+			if _, ok := mirrors[job.URL]; !ok && job.kind() == SOURCE_GIT {
+				mirror, err := filepath.Abs(path.Join(fetch.Cache, unsafeChars.ReplaceAllString(job.URL, "_")+".git"))
+				if err != nil {
+					return err
+				}
+				mirrors[job.URL] = mirror
+				urls = append(urls, job.URL)
+			}
+		}
+		err := parallel(len(urls), fetch.Jobs, func(i int, out *bytes.Buffer) error {
+			if err := updateMirror(out, urls[i], mirrors[urls[i]]); err != nil {
+				return fmt.Errorf("%s: %s", urls[i], err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return parallel(len(jobs), fetch.Jobs, func(i int, out *bytes.Buffer) error {
+		job := jobs[i]
+		var err error
+		switch job.kind() {
+		case SOURCE_PATH:
+			err = linkPath(out, job)
+		case SOURCE_ARCHIVE:
+			err = fetchArchive(out, job, fetch.Cache)
+		default:
+			source := job.URL
+			if mirror, ok := mirrors[job.URL]; ok {
+				source = "file://" + mirror
+			}
+			err = checkout(out, job, source, fetch.Shallow)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", job.Dir, err)
+		}
+		return nil
+	})
+}
+
+// updateMirror clones a bare mirror of a repository, or fetches what
+// changed since the last build.
+func updateMirror(out *bytes.Buffer, url string, mirror string) error {
+	if _, err := os.Stat(mirror); err == nil {
+		return runGit(out, "", "-C", mirror, "remote", "update", "--prune")
+	}
+	if err := os.MkdirAll(path.Dir(mirror), 0777); err != nil {
+		return err
+	}
+	return runGit(out, "", "clone", "--mirror", url, mirror)
+}
+
+// checkout fetches the commit of a dependency from source and checks it
+// out, creating the checkout if needed. Servers that don't serve single
+// commits get a full fetch.
+func checkout(out *bytes.Buffer, job fetchJob, source string, shallow bool) error {
+
+	fmt.Fprintf(out, "fetching %s into %s\n", job.key(), job.Dir)
+
+	if _, err := os.Stat(path.Join(job.Dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(job.Dir, 0777); err != nil {
+			return err
+		}
+		if err := runGit(out, job.Dir, "init", "-q"); err != nil {
+			return err
+		}
+		if err := runGit(out, job.Dir, "remote", "add", "origin", job.URL); err != nil {
+			return err
+		}
+	}
+
+	target := job.Commit
+	if target == "" {
+		target = job.Ref
+	}
+	if target == "" {
+		target = "HEAD"
+	}
+
+	args := []string{"fetch", "-q"}
+	if shallow {
+		args = append(args, "--depth", "1")
+	}
+	err := runGit(out, job.Dir, append(args, source, target)...)
+	if err != nil && job.Commit != "" {
+		err = runGit(out, job.Dir, "fetch", "-q", source, "+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*")
+		target = job.Commit
+	} else {
+		target = "FETCH_HEAD"
+	}
+	if err != nil {
+		return err
+	}
+
+	return runGit(out, job.Dir, "checkout", "-q", "--force", target)
+}
+
+// runGit runs git in dir, writing the command and its output to out.
+func runGit(out *bytes.Buffer, dir string, args ...string) error {
+	cmd := gitCommand(args...)
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	fmt.Fprintf(out, "+ %s\n", strings.Join(cmd.Args, " "))
+	return cmd.Run()
+}
+
+// parallel runs n tasks, at most jobs at a time. The output of each task
+// is printed as a whole when it ends, and every failure is reported.
+func parallel(n int, jobs int, task func(i int, out *bytes.Buffer) error) error {
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var problems []string
+	slots := make(chan struct{}, jobs)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			var out bytes.Buffer
+			err := task(i, &out)
+
+			mu.Lock()
+			defer mu.Unlock()
+			os.Stdout.Write(out.Bytes())
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("fetch failed:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDependencyDir(t *testing.T) {
+
+	tests := []struct {
+		url     string
+		deptype int
+		basedir string
+		want    string
+	}{
+		{"https://example.com/kicad/parts.git", DEP_TYPE_LIB, "/usr/share/kicad", "/usr/share/kicad/library/parts"},
+		{"https://example.com/kicad/parts.pretty/", DEP_TYPE_PRETTY, "/usr/share/kicad", "/usr/share/kicad/footprints/parts.pretty"},
+		{"git@example.com:kicad/models.git", DEP_TYPE_3D, "/kicad", "/kicad/modules/packages3d/models"},
+		{"https://example.com/kicad/templates", DEP_TYPE_TEMPLATE, "deps", "deps/template/templates"},
+		{"https://example.com/kicad/logos.git", DEP_TYPE_SVG, "deps", "deps/svg-lib/logos"},
+	}
+
+	for _, tt := range tests {
+		if got := dependencyDir(Dependency{URL: tt.url}, tt.deptype, tt.basedir); got != tt.want {
+			t.Errorf("dependencyDir(%q, %d, %q) = %q, want %q", tt.url, tt.deptype, tt.basedir, got, tt.want)
+		}
+	}
+}
+
+func TestFetchJobs(t *testing.T) {
+
+	parts := Dependency{URL: "https://example.com/parts.git"}
+	other := Dependency{URL: "https://example.org/parts.git"}
+	models := Dependency{URL: "https://example.com/models.git", Ref: "v1"}
+	sha := strings.Repeat("a", 40)
+
+	project := func(basedir string, libs []Dependency, models []Dependency) Project {
+		var p Project
+		p.Dependencies.Basedir = basedir
+		p.Dependencies.Libraries = libs
+		p.Dependencies.Modules3d = models
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		projects []Project
+		lock     map[string]string
+		want     []fetchJob
+		err      string
+	}{
+		{
+			name: "shared by projects",
+			projects: []Project{
+				project("", []Dependency{parts}, []Dependency{models}),
+				project("", []Dependency{parts}, nil),
+			},
+			lock: map[string]string{parts.key(): sha},
+			want: []fetchJob{
+				{parts, DEP_TYPE_LIB, "/usr/share/kicad/library/parts", sha},
+				{models, DEP_TYPE_3D, "/usr/share/kicad/modules/packages3d/models", ""},
+			},
+		},
+		{
+			name: "different base directories",
+			projects: []Project{
+				project("a", []Dependency{parts}, nil),
+				project("b", []Dependency{parts}, nil),
+			},
+			want: []fetchJob{{parts, DEP_TYPE_LIB, "a/library/parts", ""}, {parts, DEP_TYPE_LIB, "b/library/parts", ""}},
+		},
+		{
+			name: "same commit by ref and by sha",
+			projects: []Project{
+				project("", []Dependency{parts}, nil),
+				project("", []Dependency{{URL: parts.URL, Ref: sha}}, nil),
+			},
+			lock: map[string]string{parts.key(): sha, parts.URL + " " + sha: sha},
+			want: []fetchJob{{parts, DEP_TYPE_LIB, "/usr/share/kicad/library/parts", sha}},
+		},
+		{
+			name: "different repositories",
+			projects: []Project{
+				project("", []Dependency{parts}, nil),
+				project("", []Dependency{other}, nil),
+			},
+			err: "conflicting dependencies:\n  - /usr/share/kicad/library/parts: wanted both as https://example.com/parts.git HEAD and as https://example.org/parts.git HEAD",
+		},
+		{
+			name: "different refs",
+			projects: []Project{
+				project("", []Dependency{parts}, nil),
+				project("", []Dependency{{URL: parts.URL, Ref: "v2"}}, nil),
+			},
+			err: "conflicting dependencies:\n  - /usr/share/kicad/library/parts: wanted both as https://example.com/parts.git HEAD and as https://example.com/parts.git v2",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := fetchJobs(tt.projects, tt.lock)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetchDependencies(t *testing.T) {
+
+	lib, first, removeLib := testRepo(t, map[string]string{"parts.lib": "first"})
+	defer removeLib()
+	second := testCommit(t, lib, map[string]string{"parts.lib": "second"})
+
+	tests := []struct {
+		name   string
+		fetch  Fetch
+		commit string
+		want   string
+	}{
+		{name: "ref", fetch: Fetch{Jobs: 2}, want: "second"},
+		{name: "locked commit", fetch: Fetch{Jobs: 2}, commit: first, want: "first"},
+		{name: "shallow", fetch: Fetch{Jobs: 2, Shallow: true}, commit: second, want: "second"},
+		{name: "cache", fetch: Fetch{Jobs: 2, Cache: "cache"}, commit: first, want: "first"},
+	}
+
+	for _, tt := range tests {
+		dir, remove := testDir(t, nil)
+		if tt.fetch.Cache != "" {
+			tt.fetch.Cache = filepath.Join(dir, tt.fetch.Cache)
+		}
+		job := fetchJob{Dependency: Dependency{URL: lib, Type: SOURCE_GIT}, Dir: filepath.Join(dir, "library", "parts"), Commit: tt.commit}
+
+		// A second fetch updates the checkout in place
+		var got []byte
+		err := fetchDependencies([]fetchJob{job}, tt.fetch)
+		if err == nil {
+			err = fetchDependencies([]fetchJob{job}, tt.fetch)
+		}
+		if err == nil {
+			got, err = ioutil.ReadFile(filepath.Join(job.Dir, "parts.lib"))
+		}
+		remove()
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if string(got) != tt.want {
+			t.Errorf("%s: checked out %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
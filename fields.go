@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// applies tells whether a field rule covers a part.
+func (rule FieldRule) applies(part PartStatus) bool {
+	if part.Status == PART_REMOVED || (part.Status == PART_DNP && !rule.Dnp) {
+		return false
+	}
+	return (len(rule.Refs) == 0 || matchAny(rule.Refs, part.Ref)) &&
+		(len(rule.Symbols) == 0 || matchAny(rule.Symbols, part.Symbol))
+}
+
+// fieldFindings checks the fields of the parts against the rules: required
+// fields must be set and restricted fields hold an allowed value.
+func fieldFindings(parts []PartStatus, rules []FieldRule, variant string) []Finding {
+
+	var findings []Finding
+	add := func(part PartStatus, name string, check string, format string, args ...interface{}) {
+		message := part.Ref + ": " + fmt.Sprintf(format, args...)
+		for _, overridden := range part.Overridden {
+			if strings.EqualFold(overridden, name) {
+				message += fmt.Sprintf(" (overridden by variant %s)", variant)
+			}
+		}
+		findings = append(findings, Finding{File: part.File, Line: part.Line, Check: check, Message: message})
+	}
+
+	for _, part := range parts {
+		for _, rule := range rules {
+			if !rule.applies(part) {
+				continue
+			}
+			for _, name := range rule.Require {
+				if strings.TrimSpace(part.Field(name)) == "" {
+					add(part, name, "missing-field", "%s is empty", name)
+				}
+			}
+			names := make([]string, 0, len(rule.Values))
+			for name := range rule.Values {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				allowed := rule.Values[name]
+				values := []string{part.Field(name)}
+				if strings.EqualFold(name, variantField) {
+					values = part.Keys
+				}
+				for _, value := range values {
+					if value != "" && !containsFold(allowed, value) {
+						add(part, name, "invalid-field", "%s %q is not one of %s", name, value, strings.Join(allowed, ", "))
+					}
+				}
+			}
+		}
+	}
+
+	return findings
+}
+
+// projectParts returns the parts of a schematic as the project BOM lists
+// them: every part fitted, except DNP ones.
+func projectParts(sch Schematic) []PartStatus {
+	var parts []PartStatus
+	for _, c := range sch.Parts() {
+		keys := partKeys(c)
+		status := PART_FITTED
+		if isDNP(c, keys) {
+			status = PART_DNP
+		}
+		parts = append(parts, PartStatus{Component: c, Keys: keys, Status: status})
+	}
+	return parts
+}
+
+// completeness checks the fields of the parts of a project and of each of
+// its variants. A part lacking a field in several BOMs is reported once.
+func completeness(project Project) []Finding {
+
+	rules := len(project.Options.Fields) > 0
+	for _, variant := range project.Variants {
+		rules = rules || len(variant.Options.Fields) > 0
+	}
+	if !rules {
+		return nil
+	}
+
+	file := project.Main + ".sch"
+	if _, err := os.Stat(file); err != nil {
+		return nil
+	}
+	sch, err := readSchematic(file)
+	if err != nil {
+		return []Finding{{File: file, Check: "schematic", Message: err.Error()}}
+	}
+
+	findings := fieldFindings(projectParts(sch), project.Options.Fields, "")
+	for _, variant := range project.Variants {
+		parts, err := variantParts(sch, variant)
+		if err != nil {
+			findings = append(findings, Finding{File: file, Check: "variant", Message: err.Error()})
+			continue
+		}
+		findings = append(findings, fieldFindings(parts, variant.Options.Fields, variant.Name)...)
+	}
+
+	var unique []Finding
+	seen := make(map[Finding]bool)
+	for _, finding := range findings {
+		if !seen[finding] {
+			seen[finding] = true
+			unique = append(unique, finding)
+		}
+	}
+	sortFindings(unique)
+	return unique
+}
+
+// checkFields runs the field rules of every project, adds the findings to
+// the results and returns an error listing them.
+func checkFields(projects []Project, results *Results) error {
+	var findings []Finding
+	for _, project := range projects {
+		findings = append(findings, completeness(project)...)
+	}
+	results.add(findings...)
+	return findingsError("BOM fields incomplete", findings)
+}
+
+// checkFieldRule validates the patterns of a field rule.
+func checkFieldRule(rule FieldRule) []string {
+	var problems []string
+	for key, patterns := range map[string][]string{"refs": rule.Refs, "symbols": rule.Symbols} {
+		for i, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("%s[%d]: %s", key, i, err))
+			}
+		}
+	}
+	if len(rule.Require) == 0 && len(rule.Values) == 0 {
+		problems = append(problems, "require: required unless values is set")
+	}
+	return problems
+}
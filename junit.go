@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// StepResult is the outcome of a build step
+type StepResult struct {
+	Suite    string        // Output name of the project or variant
+	Name     string        // What the step does
+	Duration time.Duration // Time the step took
+	Stdout   string        // Output of the command
+	Stderr   string        // Errors of the command
+	Failure  string        // Why the step failed, empty if it passed
+	Skipped  bool          // Not run after an earlier failure
+}
+
+type (
+	junitTestsuites struct {
+		XMLName xml.Name         `xml:"testsuites"`
+		Suites  []junitTestsuite `xml:"testsuite"`
+	}
+
+	junitTestsuite struct {
+		Name     string          `xml:"name,attr"`
+		Tests    int             `xml:"tests,attr"`
+		Failures int             `xml:"failures,attr"`
+		Skipped  int             `xml:"skipped,attr"`
+		Time     string          `xml:"time,attr"`
+		Cases    []junitTestcase `xml:"testcase"`
+		duration time.Duration
+	}
+
+	junitTestcase struct {
+		Name      string        `xml:"name,attr"`
+		Classname string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitFailure `xml:"failure,omitempty"`
+		Skipped   *junitSkipped `xml:"skipped,omitempty"`
+		SystemOut string        `xml:"system-out,omitempty"`
+		SystemErr string        `xml:"system-err,omitempty"`
+	}
+
+	junitFailure struct {
+		Message string `xml:"message,attr"`
+		Type    string `xml:"type,attr"`
+		Text    string `xml:",chardata"`
+	}
+
+	junitSkipped struct {
+		Message string `xml:"message,attr,omitempty"`
+	}
+)
+
+// add appends a test case to the suite and counts it.
+func (s *junitTestsuite) add(c junitTestcase, duration time.Duration) {
+	s.Cases = append(s.Cases, c)
+	s.Tests++
+	if c.Failure != nil {
+		s.Failures++
+	}
+	if c.Skipped != nil {
+		s.Skipped++
+	}
+	s.duration += duration
+	s.Time = seconds(s.duration)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the steps as JUnit XML, one test suite per project or
+// variant, then one test suite per check rule with a test case per
+// finding. Baselined findings are skipped, resolved ones and the ones not
+// failing the build pass.
+func (r *Results) writeJUnit(file string) error {
+
+	var suites []*junitTestsuite
+	byName := make(map[string]*junitTestsuite)
+	suite := func(name string) *junitTestsuite {
+		if s, ok := byName[name]; ok {
+			return s
+		}
+		s := &junitTestsuite{Name: name, Time: seconds(0)}
+		byName[name] = s
+		suites = append(suites, s)
+		return s
+	}
+
+	for _, step := range r.Steps {
+		c := junitTestcase{
+			Name:      step.Name,
+			Classname: step.Suite,
+			Time:      seconds(step.Duration),
+			SystemOut: step.Stdout,
+			SystemErr: step.Stderr,
+		}
+		if step.Failure != "" {
+			c.Failure = &junitFailure{Message: step.Failure, Type: "step"}
+		}
+		if step.Skipped {
+			c.Skipped = &junitSkipped{"an earlier step failed"}
+		}
+		suite(step.Suite).add(c, step.Duration)
+	}
+
+	findings := append([]Finding(nil), r.Findings...)
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Check < findings[j].Check })
+	for _, f := range findings {
+		name := workspacePath(f.File)
+		if f.Line > 0 {
+			name = fmt.Sprintf("%s:%d", name, f.Line)
+		}
+		c := junitTestcase{Name: name + ": " + f.Message, Classname: "check." + f.Check, Time: seconds(0)}
+		switch f.Baseline {
+		case "unchanged":
+			c.Skipped = &junitSkipped{"baselined"}
+		case "absent":
+			c.Name += " (resolved)"
+		default:
+			if f.Passing {
+				c.SystemOut = f.String()
+				break
+			}
+			severity := f.Severity
+			if severity == "" {
+				severity = SEVERITY_ERROR
+			}
+			c.Failure = &junitFailure{Message: f.Message, Type: severity, Text: f.String()}
+		}
+		suite("check "+f.Check).add(c, 0)
+	}
+
+	out := junitTestsuites{}
+	for _, s := range suites {
+		out.Suites = append(out.Suites, *s)
+	}
+	data, err := xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
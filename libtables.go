@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Library tables
+const (
+	symTable = "sym-lib-table"
+	fpTable  = "fp-lib-table"
+)
+
+// libEntry is a library table entry
+type libEntry struct {
+	Name string // Nickname
+	Type string // Plugin: Legacy or KiCad
+	URI  string // Library path
+}
+
+// stockDir is where the KiCad packages install the stock libraries
+const stockDir = "/usr/share/kicad"
+
+// kicadEnv returns the KiCad path variables, under their KiCad 5 and 6
+// names. The 3D model and template variables point to the fetched
+// dependencies under basedir. The symbol and footprint ones keep their
+// stock directories, which the default library tables refer to: fetched
+// libraries are reached through their table entries.
+func kicadEnv(basedir string) []string {
+	dirs := []struct {
+		names []string
+		dir   string
+	}{
+		{[]string{"KICAD_SYMBOL_DIR", "KICAD6_SYMBOL_DIR"}, path.Join(stockDir, "library")},
+		{[]string{"KISYSMOD", "KICAD6_FOOTPRINT_DIR"}, path.Join(stockDir, "modules")},
+		{[]string{"KISYS3DMOD", "KICAD6_3DMODEL_DIR"}, path.Join(basedir, "modules/packages3d")},
+		{[]string{"KICAD_TEMPLATE_DIR", "KICAD6_TEMPLATE_DIR"}, path.Join(basedir, "template")},
+	}
+	var env []string
+	for _, d := range dirs {
+		for _, name := range d.names {
+			env = append(env, name+"="+d.dir)
+		}
+	}
+	return env
+}
+
+// libEntries scans the fetched symbol and footprint dependencies for
+// libraries: .lib and .kicad_sym files, and .pretty directories.
+func libEntries(jobs []fetchJob) ([]libEntry, []libEntry) {
+
+	var symbols, footprints []libEntry
+	for _, job := range jobs {
+		if job.Type != DEP_TYPE_LIB && job.Type != DEP_TYPE_PRETTY {
+			continue
+		}
+		// The trailing slash follows linked path dependencies
+		filepath.Walk(job.Dir+"/", func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			name := info.Name()
+			if info.IsDir() && name == ".git" {
+				return filepath.SkipDir
+			}
+			switch {
+			case job.Type == DEP_TYPE_PRETTY && info.IsDir() && strings.HasSuffix(name, ".pretty"):
+				footprints = append(footprints, libEntry{strings.TrimSuffix(name, ".pretty"), "KiCad", path.Clean(file)})
+				return filepath.SkipDir
+			case job.Type == DEP_TYPE_LIB && !info.IsDir() && strings.HasSuffix(name, ".kicad_sym"):
+				symbols = append(symbols, libEntry{strings.TrimSuffix(name, ".kicad_sym"), "KiCad", path.Clean(file)})
+			case job.Type == DEP_TYPE_LIB && !info.IsDir() && strings.HasSuffix(name, ".lib") &&
+				!strings.HasSuffix(name, "-cache.lib") && !strings.HasSuffix(name, "-rescue.lib"):
+				symbols = append(symbols, libEntry{strings.TrimSuffix(name, ".lib"), "Legacy", path.Clean(file)})
+			}
+			return nil
+		})
+	}
+
+	return symbols, footprints
+}
+
+// kicadConfigDir returns the directory of the KiCad global settings.
+func kicadConfigDir() string {
+	if dir := os.Getenv("KICAD_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	home := os.Getenv("HOME")
+	if u, err := user.Current(); err == nil && home == "" {
+		home = u.HomeDir
+	}
+	return path.Join(home, ".config", "kicad")
+}
+
+// writeLibTables adds the libraries of the fetched dependencies to the
+// global library tables. Tables are created from the KiCad template
+// tables if missing.
+func writeLibTables(jobs []fetchJob) error {
+
+	symbols, footprints := libEntries(jobs)
+	dir := kicadConfigDir()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	for _, table := range []struct {
+		name    string
+		entries []libEntry
+	}{
+		{symTable, symbols},
+		{fpTable, footprints},
+	} {
+		if len(table.entries) == 0 {
+			continue
+		}
+		err := mergeLibTable(path.Join(dir, table.name), path.Join("/usr/share/kicad/template", table.name), table.entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeLibTable adds entries to a library table, replacing the entries
+// with the same nicknames. Two entries with the same nickname keep the
+// first one.
+func mergeLibTable(file string, template string, entries []libEntry) error {
+
+	root := strings.Replace(path.Base(file), "-", "_", -1)
+	table, err := readSexpr(file)
+	if os.IsNotExist(err) {
+		table, err = readSexpr(template)
+	}
+	if os.IsNotExist(err) {
+		table, err = parseSexpr("(" + root + ")")
+	}
+	if err != nil {
+		return err
+	}
+
+	added := make(map[string]string)
+	var libs []*Node
+	for _, entry := range entries {
+		if uri, ok := added[entry.Name]; ok {
+			if uri != entry.URI {
+				fmt.Printf("%s: %s is both %s and %s, keeping the first\n", path.Base(file), entry.Name, uri, entry.URI)
+			}
+			continue
+		}
+		added[entry.Name] = entry.URI
+		lib, err := parseSexpr(fmt.Sprintf("(lib (name %s) (type %s) (uri %s) (options \"\") (descr %s))",
+			quoteAtom(entry.Name), entry.Type, quoteAtom(entry.URI), quoteAtom("drone-kicad dependency")))
+		if err != nil {
+			return err
+		}
+		libs = append(libs, lib)
+	}
+
+	var b strings.Builder
+	b.WriteString("(" + root + "\n")
+	for _, lib := range table.Children("lib") {
+		if name := lib.Child("name"); name != nil {
+			if uri, ok := added[name.Arg(0)]; ok {
+				fmt.Printf("%s: replacing %s with %s\n", path.Base(file), name.Arg(0), uri)
+				continue
+			}
+		}
+		b.WriteString("  " + lib.String() + "\n")
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].Child("name").Arg(0) < libs[j].Child("name").Arg(0) })
+	for _, lib := range libs {
+		b.WriteString("  " + lib.String() + "\n")
+	}
+	b.WriteString(")\n")
+
+	fmt.Printf("%s: %d libraries from dependencies\n", file, len(libs))
+	return ioutil.WriteFile(file, []byte(b.String()), 0644)
+}
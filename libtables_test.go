@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKicadEnv(t *testing.T) {
+
+	tests := []struct {
+		basedir string
+		want    []string
+	}{
+		{
+			basedir: "/usr/share/kicad",
+			want: []string{
+				"KICAD_SYMBOL_DIR=/usr/share/kicad/library",
+				"KICAD6_SYMBOL_DIR=/usr/share/kicad/library",
+				"KISYSMOD=/usr/share/kicad/modules",
+				"KICAD6_FOOTPRINT_DIR=/usr/share/kicad/modules",
+				"KISYS3DMOD=/usr/share/kicad/modules/packages3d",
+				"KICAD6_3DMODEL_DIR=/usr/share/kicad/modules/packages3d",
+				"KICAD_TEMPLATE_DIR=/usr/share/kicad/template",
+				"KICAD6_TEMPLATE_DIR=/usr/share/kicad/template",
+			},
+		},
+		{
+			basedir: "deps",
+			want: []string{
+				"KICAD_SYMBOL_DIR=/usr/share/kicad/library",
+				"KICAD6_SYMBOL_DIR=/usr/share/kicad/library",
+				"KISYSMOD=/usr/share/kicad/modules",
+				"KICAD6_FOOTPRINT_DIR=/usr/share/kicad/modules",
+				"KISYS3DMOD=deps/modules/packages3d",
+				"KICAD6_3DMODEL_DIR=deps/modules/packages3d",
+				"KICAD_TEMPLATE_DIR=deps/template",
+				"KICAD6_TEMPLATE_DIR=deps/template",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := kicadEnv(tt.basedir); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("kicadEnv(%q) = %q, want %q", tt.basedir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lockFile pins every dependency to a commit, in the workspace root
+const lockFile = "kicad-deps.lock"
+
+// Lock modes
+const (
+	LOCK_AUTO   = "auto"   // Use locked commits, lock new dependencies
+	LOCK_FROZEN = "frozen" // Use locked commits, fail if the lock is stale
+	LOCK_UPDATE = "update" // Resolve every ref again
+	LOCK_OFF    = "off"    // Ignore the lock, clone refs
+)
+
+var shaPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// key identifies a dependency in the lock
+func (d Dependency) key() string {
+	ref := d.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return d.URL + " " + ref
+}
+
+// lockDependencies returns the commit of each git dependency of the
+// projects by key, reading and updating the lock file as mode says.
+// Archives are pinned by their checksum and local paths are not pinned.
+func lockDependencies(projects []Project, mode string) (map[string]string, error) {
+
+	switch mode {
+	case LOCK_OFF:
+		return nil, nil
+	case LOCK_AUTO, LOCK_FROZEN, LOCK_UPDATE:
+	default:
+		return nil, fmt.Errorf("lock: unknown mode %q, expected %s, %s, %s or %s", mode, LOCK_AUTO, LOCK_FROZEN, LOCK_UPDATE, LOCK_OFF)
+	}
+
+	locked, err := readLock(lockFile)
+	if err != nil {
+		return nil, err
+	}
+
+	deps := make(map[string]Dependency)
+	for _, project := range projects {
+		for _, dep := range project.Dependencies.list() {
+			if dep.kind() == SOURCE_GIT {
+				deps[dep.key()] = dep.Dependency
+			}
+		}
+	}
+	var keys []string
+	for key := range deps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	resolved := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if sha, ok := locked[key]; ok && mode != LOCK_UPDATE {
+			resolved[key] = sha
+			continue
+		}
+		if mode == LOCK_FROZEN {
+			problems = append(problems, fmt.Sprintf("%s: not locked", key))
+			continue
+		}
+		sha, err := resolveRef(deps[key].URL, deps[key].Ref)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("locked %s at %s\n", key, sha)
+		resolved[key] = sha
+	}
+	for key := range locked {
+		if _, ok := deps[key]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: no longer a dependency", key))
+		}
+	}
+
+	if mode == LOCK_FROZEN {
+		if len(problems) > 0 {
+			sort.Strings(problems)
+			return nil, fmt.Errorf("%s is stale, run drone-kicad lock:\n  - %s", lockFile, strings.Join(problems, "\n  - "))
+		}
+		return resolved, nil
+	}
+
+	if !sameLock(locked, resolved) {
+		if err := writeLock(lockFile, resolved); err != nil {
+			return nil, err
+		}
+		fmt.Printf("%s updated\n", lockFile)
+	}
+
+	return resolved, nil
+}
+
+// resolveRef returns the commit a ref of a remote repository points to.
+// Annotated tags resolve to the commit they tag.
+func resolveRef(url string, ref string) (string, error) {
+
+	if shaPattern.MatchString(ref) {
+		return ref, nil
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := gitCommand("ls-remote", url, ref, ref+"^{}")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: git ls-remote: %s", url, strings.TrimSpace(stderr.String()))
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range []string{"refs/tags/" + ref + "^{}", "refs/tags/" + ref, "refs/heads/" + ref, ref} {
+		if sha, ok := refs[name]; ok {
+			return sha, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: ref %s not found (commits must be given as full sha)", url, ref)
+}
+
+// readLock reads a lock file, returning an empty lock if there is none.
+func readLock(file string) (map[string]string, error) {
+
+	locked := make(map[string]string)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return locked, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseLock(file, f)
+}
+
+// parseLock reads the lines of a lock, file naming it in errors.
+func parseLock(file string, r io.Reader) (map[string]string, error) {
+
+	locked := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !shaPattern.MatchString(fields[2]) {
+			return nil, fmt.Errorf("%s:%d: expected url, ref and commit sha", file, n)
+		}
+		locked[fields[0]+" "+fields[1]] = fields[2]
+	}
+
+	return locked, scanner.Err()
+}
+
+// writeLock writes a lock file, one dependency per line sorted by URL and
+// ref.
+func writeLock(file string, locked map[string]string) error {
+
+	var keys []string
+	for key := range locked {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("# Generated by drone-kicad lock: url, ref and commit of each dependency\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s %s\n", key, locked[key])
+	}
+
+	return ioutil.WriteFile(file, []byte(b.String()), 0644)
+}
+
+func sameLock(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, sha := range a {
+		if b[key] != sha {
+			return false
+		}
+	}
+	return true
+}
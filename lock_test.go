@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDependencyKey(t *testing.T) {
+
+	tests := []struct {
+		dep  Dependency
+		want string
+	}{
+		{Dependency{URL: "https://example.com/lib.git"}, "https://example.com/lib.git HEAD"},
+		{Dependency{URL: "https://example.com/lib.git", Ref: "v1.0"}, "https://example.com/lib.git v1.0"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dep.key(); got != tt.want {
+			t.Errorf("%+v.key() = %q, want %q", tt.dep, got, tt.want)
+		}
+	}
+}
+
+func TestReadLock(t *testing.T) {
+
+	sha := strings.Repeat("a", 40)
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		err     string
+	}{
+		{
+			name:    "comments and blank lines",
+			content: "# header\n\nhttps://example.com/lib.git HEAD " + sha + "\n",
+			want:    map[string]string{"https://example.com/lib.git HEAD": sha},
+		},
+		{
+			name:    "missing ref",
+			content: "# header\nhttps://example.com/lib.git " + sha + "\n",
+			err:     "kicad-deps.lock:2: expected url, ref and commit sha",
+		},
+		{
+			name:    "short sha",
+			content: "https://example.com/lib.git HEAD abc123\n",
+			err:     "kicad-deps.lock:1: expected url, ref and commit sha",
+		},
+	}
+
+	dir, remove := testDir(t, nil)
+	defer remove()
+	file := filepath.Join(dir, lockFile)
+
+	if got, err := readLock(file); err != nil || len(got) != 0 {
+		t.Errorf("missing file: got %v, %v, want an empty lock", got, err)
+	}
+
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readLock(file)
+		if tt.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestWriteLock(t *testing.T) {
+
+	dir, remove := testDir(t, nil)
+	defer remove()
+	file := filepath.Join(dir, lockFile)
+
+	locked := map[string]string{
+		"https://example.com/b.git v2":   strings.Repeat("b", 40),
+		"https://example.com/a.git HEAD": strings.Repeat("a", 40),
+	}
+	if err := writeLock(file, locked); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "https://example.com/a.git") {
+		t.Errorf("lock not sorted by url:\n%s", data)
+	}
+
+	got, err := readLock(file)
+	if err != nil || !sameLock(got, locked) {
+		t.Errorf("round trip: got %v, %v, want %v", got, err, locked)
+	}
+}
+
+func TestSameLock(t *testing.T) {
+
+	a, b := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	tests := []struct {
+		x, y map[string]string
+		want bool
+	}{
+		{nil, map[string]string{}, true},
+		{map[string]string{"lib HEAD": a}, map[string]string{"lib HEAD": a}, true},
+		{map[string]string{"lib HEAD": a}, map[string]string{"lib HEAD": b}, false},
+		{map[string]string{"lib HEAD": a}, map[string]string{"lib v1": a}, false},
+		{map[string]string{"lib HEAD": a}, map[string]string{"lib HEAD": a, "lib v1": a}, false},
+	}
+
+	for _, tt := range tests {
+		if got := sameLock(tt.x, tt.y); got != tt.want {
+			t.Errorf("sameLock(%v, %v) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestLockDependencies(t *testing.T) {
+
+	lib, first, removeLib := testRepo(t, map[string]string{"parts.lib": "lib"})
+	defer removeLib()
+	testGit(t, lib, "-c", "user.name=test", "-c", "user.email=test@example.com", "tag", "-a", "-m", "v1", "v1")
+	second := testCommit(t, lib, map[string]string{"parts.lib": "changed"})
+
+	projects := []Project{{Main: "a/a"}}
+	projects[0].Dependencies.Libraries = []Dependency{{URL: lib, Ref: "v1", Type: SOURCE_GIT}, {URL: lib, Type: SOURCE_GIT}}
+	tagged, head := lib+" v1", lib+" HEAD"
+
+	dir, remove := testDir(t, nil)
+	defer remove()
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+
+	tests := []struct {
+		name   string
+		mode   string
+		locked map[string]string
+		want   map[string]string
+		err    string
+	}{
+		{name: "off", mode: LOCK_OFF},
+		{
+			name: "auto locks new dependencies",
+			mode: LOCK_AUTO,
+			want: map[string]string{tagged: first, head: second},
+		},
+		{
+			name:   "auto keeps locked commits",
+			mode:   LOCK_AUTO,
+			locked: map[string]string{tagged: first, head: first},
+			want:   map[string]string{tagged: first, head: first},
+		},
+		{
+			name:   "update resolves again",
+			mode:   LOCK_UPDATE,
+			locked: map[string]string{tagged: first, head: first},
+			want:   map[string]string{tagged: first, head: second},
+		},
+		{
+			name:   "frozen",
+			mode:   LOCK_FROZEN,
+			locked: map[string]string{tagged: first, head: first},
+			want:   map[string]string{tagged: first, head: first},
+		},
+		{
+			name:   "frozen and stale",
+			mode:   LOCK_FROZEN,
+			locked: map[string]string{tagged: first, "https://example.com/old.git HEAD": first},
+			err:    "kicad-deps.lock is stale, run drone-kicad lock:\n  - " + head + ": not locked\n  - https://example.com/old.git HEAD: no longer a dependency",
+		},
+		{name: "unknown mode", mode: "never", err: `lock: unknown mode "never", expected auto, frozen, update or off`},
+	}
+
+	for _, tt := range tests {
+		os.Remove(lockFile)
+		if tt.locked != nil {
+			if err := writeLock(lockFile, tt.locked); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := lockDependencies(projects, tt.mode)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		// The lock file is written unless frozen or off
+		written, _ := readLock(lockFile)
+		if tt.mode == LOCK_AUTO || tt.mode == LOCK_UPDATE {
+			if !sameLock(written, tt.want) {
+				t.Errorf("%s: lock file %v, want %v", tt.name, written, tt.want)
+			}
+		} else if !sameLock(written, tt.locked) {
+			t.Errorf("%s: lock file changed to %v", tt.name, written)
+		}
+	}
+}
@@ -12,12 +12,63 @@ import (
 var build = "0" // build number set at compile-time
 
 func main() {
+	importInputs()
+	if err := newApp().Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// newApp declares the commands and the flags of the plugin.
+func newApp() *cli.App {
 
 	app := cli.NewApp()
 	app.Name = "kicad plugin"
 	app.Usage = "kicad plugin"
 	app.Action = run
 	app.Version = fmt.Sprintf("0.0.%s", build)
+	app.Commands = []cli.Command{
+		{
+			Name:      "validate",
+			Usage:     "check the configuration without building",
+			ArgsUsage: "[settings.json]",
+			Action:    validate,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "print",
+					Usage: "print the resolved configuration, after defaults and inheritance",
+				},
+			},
+		},
+		{
+			Name:      "lock",
+			Usage:     "resolve the dependency refs and write " + lockFile,
+			ArgsUsage: "[settings.json]",
+			Action:    lock,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "update",
+					Usage: "resolve every ref again, not only new dependencies",
+				},
+			},
+		},
+		{
+			Name:      "fetch",
+			Usage:     "fetch the dependencies without building",
+			ArgsUsage: "[settings.json]",
+			Action:    fetch,
+		},
+		{
+			Name:      "baseline",
+			Usage:     "accept the DRC and ERC violations of the last build in " + baselineFile,
+			ArgsUsage: "[settings.json]",
+			Action:    baseline,
+		},
+		{
+			Name:   "schema",
+			Usage:  "print the JSON Schema of the configuration",
+			Action: schema,
+		},
+	}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "client.code",
@@ -29,61 +80,361 @@ func main() {
 			Usage:  "client name",
 			EnvVar: "PLUGIN_CLIENT_NAME",
 		},
+		cli.StringFlag{
+			Name:   "defaults",
+			Usage:  "settings applied to every project",
+			EnvVar: "PLUGIN_DEFAULTS",
+		},
 		cli.StringFlag{
 			Name:   "projects",
 			Usage:  "projects structure",
 			EnvVar: "PLUGIN_PROJECTS",
 		},
 		cli.StringFlag{
-			Name:   "netrc.machine",
-			Usage:  "netrc machine",
-			EnvVar: "DRONE_NETRC_MACHINE",
+			Name:   "discover",
+			Usage:  "project discovery",
+			EnvVar: "PLUGIN_DISCOVER",
+		},
+		cli.StringFlag{
+			Name:   "profiles",
+			Usage:  "settings per build event",
+			EnvVar: "PLUGIN_PROFILES",
+		},
+		cli.StringFlag{
+			Name:   "credentials",
+			Usage:  "authentication of dependencies",
+			EnvVar: "PLUGIN_CREDENTIALS",
+		},
+		cli.StringFlag{
+			Name:   "fabs",
+			Usage:  "fab presets by name",
+			EnvVar: "PLUGIN_FABS",
 		},
 		cli.StringFlag{
-			Name:   "netrc.username",
-			Usage:  "netrc username",
-			EnvVar: "DRONE_NETRC_USERNAME",
+			Name:   "signing.key",
+			Usage:  "private GPG key signing release packages",
+			EnvVar: "PLUGIN_SIGNING_KEY",
 		},
 		cli.StringFlag{
-			Name:   "netrc.password",
-			Usage:  "netrc password",
-			EnvVar: "DRONE_NETRC_PASSWORD",
+			Name:   "signing.passphrase",
+			Usage:  "passphrase of the signing key",
+			EnvVar: "PLUGIN_SIGNING_PASSPHRASE",
 		},
 		cli.StringFlag{
-			Name:   "commit.tag",
-			Usage:  "commit tag",
-			EnvVar: "DRONE_TAG",
+			Name:   "ci",
+			Usage:  "CI system: drone, woodpecker, gitlab, github or local, detected by default",
+			EnvVar: "PLUGIN_CI",
 		},
 		cli.StringFlag{
-			Name:   "commit.sha",
-			Usage:  "commit sha",
-			EnvVar: "DRONE_COMMIT_SHA",
+			Name:  "build.number",
+			Usage: "build number, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "build.event",
+			Usage: "build event, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "commit.branch",
+			Usage: "commit branch, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "netrc.machine",
+			Usage: "netrc machine, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "netrc.username",
+			Usage: "netrc username, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "netrc.password",
+			Usage: "netrc password, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "commit.tag",
+			Usage: "commit tag, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "commit.sha",
+			Usage: "commit sha, detected from the CI by default",
+		},
+		cli.StringFlag{
+			Name:  "commit.before",
+			Usage: "previous commit sha, detected from the CI by default",
+		},
+		cli.BoolFlag{
+			Name:   "changed.only",
+			Usage:  "only build projects changed since the previous commit",
+			EnvVar: "PLUGIN_CHANGED_ONLY",
+		},
+		cli.StringFlag{
+			Name:   "lock",
+			Usage:  "dependency lock mode: auto, frozen, update or off",
+			Value:  LOCK_AUTO,
+			EnvVar: "PLUGIN_LOCK",
+		},
+		cli.StringFlag{
+			Name:   "fetch.cache",
+			Usage:  "directory keeping repository mirrors between builds",
+			EnvVar: "PLUGIN_FETCH_CACHE",
+		},
+		cli.IntFlag{
+			Name:   "fetch.jobs",
+			Usage:  "repositories fetched at once",
+			Value:  4,
+			EnvVar: "PLUGIN_FETCH_JOBS",
+		},
+		cli.BoolTFlag{
+			Name:   "fetch.shallow",
+			Usage:  "fetch only the checked out commit of dependencies",
+			EnvVar: "PLUGIN_FETCH_SHALLOW",
+		},
+		cli.BoolFlag{
+			Name:   "fetch.only",
+			Usage:  "fetch or update the dependencies and stop",
+			EnvVar: "PLUGIN_FETCH_ONLY",
+		},
+		cli.BoolTFlag{
+			Name:   "lib.tables",
+			Usage:  "add the fetched libraries to the KiCad library tables",
+			EnvVar: "PLUGIN_LIB_TABLES",
+		},
+		cli.BoolFlag{
+			Name:   "preflight",
+			Usage:  "check that symbols, footprints and 3D models resolve before building",
+			EnvVar: "PLUGIN_PREFLIGHT",
+		},
+		cli.BoolFlag{
+			Name:   "consistency",
+			Usage:  "check that the schematic and the board match before building",
+			EnvVar: "PLUGIN_CONSISTENCY",
+		},
+		cli.StringFlag{
+			Name:   "sarif",
+			Usage:  "file the check findings are written to as SARIF, none if empty",
+			Value:  "CI-BUILD/drone-kicad.sarif",
+			EnvVar: "PLUGIN_SARIF",
+		},
+		cli.StringFlag{
+			Name:   "junit",
+			Usage:  "file the steps and check findings are written to as JUnit XML, none if empty",
+			Value:  "CI-BUILD/drone-kicad-junit.xml",
+			EnvVar: "PLUGIN_JUNIT",
+		},
+		cli.BoolTFlag{
+			Name:   "full.build.on.tag",
+			Usage:  "build all projects on tags, even with changed.only",
+			EnvVar: "PLUGIN_FULL_BUILD_ON_TAG",
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		logrus.Fatal(err)
-	}
+	return app
 }
 
 func run(c *cli.Context) error {
 
+	if problems := checkPluginEnv(c.App.Flags); len(problems) > 0 {
+		return ConfigError{problems}
+	}
+
+	env, err := ciEnvironment(c)
+	if err != nil {
+		return err
+	}
+	if env.Commit.Sha == "" {
+		fmt.Printf("warning: commit sha unknown, set --commit.sha: outputs are tagged %q\n", env.Commit.short())
+	}
+	fmt.Printf("%s build %s: %s on %s at %s\n", env.CI, env.Build.Number, env.Build.Event, env.Build.Branch, env.Commit.Sha)
+
+	config, err := loadConfig(c, env.Build)
+	if err != nil {
+		return err
+	}
+	if problems := checkReferences(config); len(problems) > 0 {
+		return ConfigError{problems}
+	}
+
+	var profile *Profile
+	if i := matchProfile(config.Profiles, env.Build); i >= 0 {
+		profile = &config.Profiles[i]
+		fmt.Printf("using profile %d\n", i)
+	}
+
 	plugin := Plugin{
-		Netrc: Netrc{
-			Login:    c.String("netrc.username"),
-			Machine:  c.String("netrc.machine"),
-			Password: c.String("netrc.password"),
-		},
-		Commit: Commit{
-			Tag: c.String("commit.tag"),
-			Sha: c.String("commit.sha"),
+		Projects:       config.Projects,
+		Netrc:          env.Netrc,
+		Credentials:    config.Credentials,
+		Commit:         env.Commit,
+		ChangedOnly:    c.Bool("changed.only"),
+		FullBuildOnTag: c.BoolT("full.build.on.tag"),
+		LockMode:       c.String("lock"),
+		Fetch:          fetchOptions(c),
+		LibTables:      c.BoolT("lib.tables"),
+		Preflight:      c.Bool("preflight"),
+		Consistency:    c.Bool("consistency"),
+		Sarif:          c.String("sarif"),
+		Junit:          c.String("junit"),
+		Fabs:           config.Fabs,
+		Profile:        profile,
+		Signing: Signing{
+			Key:        c.String("signing.key"),
+			Passphrase: c.String("signing.passphrase"),
 		},
 	}
 
-	err := json.Unmarshal([]byte(c.String("projects")), &plugin.Projects)
+	return plugin.Exec()
+}
+
+// validate checks the configuration given in a settings file, or the one
+// from the environment when no file is given.
+func validate(c *cli.Context) error {
+
+	env, err := ciEnvironment(c)
+	if err != nil {
+		return err
+	}
+
+	var config Config
+	if c.NArg() > 0 {
+		config, err = loadConfigFile(c.Args().First(), env.Build)
+	} else {
+		if problems := checkPluginEnv(c.App.Flags); len(problems) > 0 {
+			return ConfigError{problems}
+		}
+		config, err = loadConfig(c, env.Build)
+	}
 	if err != nil {
 		return err
 	}
+	if problems := checkReferences(config); len(problems) > 0 {
+		return ConfigError{problems}
+	}
 
-	return plugin.Exec()
+	// A frozen lock is checked without resolving anything
+	if c.GlobalString("lock") == LOCK_FROZEN {
+		if _, err := lockDependencies(config.Projects, LOCK_FROZEN); err != nil {
+			return err
+		}
+	}
+
+	if c.Bool("print") {
+		data, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+
+	fmt.Printf("configuration is valid (%d projects)\n", len(config.Projects))
+	return nil
+}
+
+// lock resolves the dependencies of the configuration given in a settings
+// file, or the one from the environment, and writes the lock file.
+func lock(c *cli.Context) error {
+
+	config, cleanup, err := commandConfig(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	mode := LOCK_AUTO
+	if c.Bool("update") {
+		mode = LOCK_UPDATE
+	}
+	locked, err := lockDependencies(config.Projects, mode)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d dependencies locked\n", lockFile, len(locked))
+	return nil
+}
+
+// fetch fetches or updates the dependencies of the configuration given in
+// a settings file, or the one from the environment.
+func fetch(c *cli.Context) error {
+
+	config, cleanup, err := commandConfig(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	lock, err := lockDependencies(config.Projects, c.GlobalString("lock"))
+	if err != nil {
+		return err
+	}
+	jobs, err := fetchJobs(config.Projects, lock)
+	if err != nil {
+		return err
+	}
+	if err := fetchDependencies(jobs, fetchOptions(c)); err != nil {
+		return err
+	}
+
+	fmt.Printf("fetched %d dependencies\n", len(jobs))
+	return nil
+}
+
+// baseline records the violations of the DRC and ERC reports of the last
+// build as accepted, for the configuration given in a settings file or the
+// one from the environment.
+func baseline(c *cli.Context) error {
+
+	config, cleanup, err := commandConfig(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := updateBaseline(config.Projects); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: updated\n", baselineFile)
+	return nil
+}
+
+// commandConfig loads the configuration of a subcommand from the settings
+// file given as argument, or from the environment, and sets up the
+// credentials. The returned function removes them.
+func commandConfig(c *cli.Context) (Config, func(), error) {
+
+	env, err := ciEnvironment(c)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	var config Config
+	if c.NArg() > 0 {
+		config, err = loadConfigFile(c.Args().First(), env.Build)
+	} else {
+		config, err = loadConfig(c, env.Build)
+	}
+	if err != nil {
+		return config, nil, err
+	}
+
+	cleanup, err := setupAuth(config.Credentials, env.Netrc)
+	return config, cleanup, err
+}
+
+func fetchOptions(c *cli.Context) Fetch {
+	return Fetch{
+		Cache:   c.GlobalString("fetch.cache"),
+		Jobs:    c.GlobalInt("fetch.jobs"),
+		Shallow: c.GlobalBoolT("fetch.shallow"),
+		Only:    c.GlobalBool("fetch.only"),
+	}
+}
+
+// schema prints the JSON Schema of the plugin settings.
+func schema(c *cli.Context) error {
+	data, err := marshalSchema(c.App.Flags)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
 }
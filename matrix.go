@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Row keys of a variant matrix that are not references
+const (
+	matrixContent = "content"
+	matrixOption  = "option."
+)
+
+// expandMatrices appends the variants defined by each project's matrix
+// file to its variants. Generated variants are checked like written ones,
+// and their references against the project schematic.
+func expandMatrices(tree interface{}, problems *[]string) interface{} {
+
+	settings, ok := tree.(map[string]interface{})
+	if !ok {
+		return tree
+	}
+	projects, _ := settings["projects"].([]interface{})
+
+	for i, p := range projects {
+		project, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		file, _ := project["matrix"].(string)
+		if file == "" {
+			continue
+		}
+		main, _ := project["main"].(string)
+
+		variants, err := readMatrix(file, main+".sch", problems)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("projects[%d].matrix: %s", i, err))
+			continue
+		}
+
+		existing, _ := project["variants"].([]interface{})
+		names := make(map[string]bool)
+		for _, v := range existing {
+			if variant, ok := v.(map[string]interface{}); ok {
+				if name, ok := variant["name"].(string); ok {
+					names[name] = true
+				}
+			}
+		}
+		for _, variant := range variants {
+			name := variant["name"].(string)
+			if names[name] {
+				*problems = append(*problems, fmt.Sprintf("%s: variant %s is also defined in projects[%d].variants", file, name, i))
+				continue
+			}
+			names[name] = true
+			at := fmt.Sprintf("%s[%s]", file, name)
+			existing = append(existing, normalizeTree(at, variant, reflect.TypeOf(Variant{}), problems))
+		}
+		project["variants"] = existing
+	}
+
+	return settings
+}
+
+// readMatrix reads a variant matrix. The header row names the variants,
+// one per column after the first. The first cell of each following row
+// says what the row sets for each variant:
+//
+//	content          the variant expression
+//	R5               whether R5 is fitted: x, yes or fit; dnp; or empty,
+//	                 no or - to remove it
+//	R5.value         a field override of R5 (value, footprint, MPN...)
+//	option.grb.all   an output option, as true/false, a number or text
+//
+// Empty override and option cells leave the value unset. Problems with
+// single rows are appended to problems.
+func readMatrix(file string, schematic string, problems *[]string) ([]map[string]interface{}, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || len(records[0]) < 2 {
+		return nil, fmt.Errorf("%s: no variant columns", file)
+	}
+
+	sch, err := readSchematic(schematic)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	known := make(map[string]bool)
+	for _, c := range sch.Parts() {
+		refs = append(refs, c.Ref)
+		known[c.Ref] = true
+	}
+
+	var variants []map[string]interface{}
+	for _, name := range records[0][1:] {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("%s:1: empty variant name", file)
+		}
+		variants = append(variants, map[string]interface{}{"name": name})
+	}
+
+	for n, record := range records[1:] {
+		line := n + 2
+		key := strings.TrimSpace(record[0])
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+
+		// Reference rows are checked against the schematic
+		ref, field := key, ""
+		if i := strings.Index(key, "."); i > 0 && !strings.HasPrefix(key, matrixOption) {
+			ref, field = key[:i], key[i+1:]
+		}
+		if key != matrixContent && !strings.HasPrefix(key, matrixOption) && !known[ref] {
+			if s := suggest(ref, refs); s != "" {
+				*problems = append(*problems, fmt.Sprintf("%s:%d: %s is not in the schematic, did you mean %q?", file, line, ref, s))
+			} else {
+				*problems = append(*problems, fmt.Sprintf("%s:%d: %s is not in the schematic", file, line, ref))
+			}
+			continue
+		}
+
+		for i, variant := range variants {
+			cell := ""
+			if i+1 < len(record) {
+				cell = strings.TrimSpace(record[i+1])
+			}
+
+			switch {
+			case key == matrixContent:
+				variant["content"] = cell
+
+			case strings.HasPrefix(key, matrixOption):
+				if cell == "" {
+					continue
+				}
+				options, _ := variant["options"].(map[string]interface{})
+				if options == nil {
+					options = make(map[string]interface{})
+					variant["options"] = options
+				}
+				setPath(options, strings.Split(strings.TrimPrefix(key, matrixOption), "."), matrixValue(cell))
+
+			case field != "":
+				if cell == "" {
+					continue
+				}
+				overrides, _ := variant["overrides"].(map[string]interface{})
+				if overrides == nil {
+					overrides = make(map[string]interface{})
+					variant["overrides"] = overrides
+				}
+				fields, _ := overrides[ref].(map[string]interface{})
+				if fields == nil {
+					fields = make(map[string]interface{})
+					overrides[ref] = fields
+				}
+				fields[field] = cell
+
+			default:
+				status, ok := matrixStatus(cell)
+				if !ok {
+					*problems = append(*problems, fmt.Sprintf("%s:%d: %s: %q is not x, dnp or empty", file, line, ref, cell))
+					continue
+				}
+				parts, _ := variant["parts"].(map[string]interface{})
+				if parts == nil {
+					parts = make(map[string]interface{})
+					variant["parts"] = parts
+				}
+				parts[ref] = status
+			}
+		}
+	}
+	return variants, nil
+}
+
+// matrixStatus maps a reference cell to a part status.
+func matrixStatus(cell string) (string, bool) {
+	switch strings.ToLower(cell) {
+	case "x", "yes", "y", "1", "fit", "fitted", "true":
+		return PART_FITTED, true
+	case "dnp":
+		return PART_DNP, true
+	case "", "-", "no", "n", "0", "false", "removed":
+		return PART_REMOVED, true
+	}
+	return "", false
+}
+
+// matrixValue converts an option cell to its JSON value.
+func matrixValue(cell string) interface{} {
+	switch strings.ToLower(cell) {
+	case "true", "yes", "x":
+		return true
+	case "false", "no", "-":
+		return false
+	case "null":
+		return nil
+	}
+	if n, err := strconv.ParseFloat(cell, 64); err == nil {
+		return n
+	}
+	return cell
+}
+
+// setPath sets a nested key of a settings object.
+func setPath(object map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		next, _ := object[key].(map[string]interface{})
+		if next == nil {
+			next = make(map[string]interface{})
+			object[key] = next
+		}
+		object = next
+	}
+	object[keys[len(keys)-1]] = value
+}
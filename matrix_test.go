@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSchematic is a KiCad 5 schematic with R1, R2, C1 and a power symbol
+const testSchematic = `EESchema Schematic File Version 4
+$Comp
+L Device:R R1
+U 1 1 5C000001
+F 0 "R1" H 0 0 50  0000 C CNN
+F 1 "10k" H 0 0 50  0000 C CNN
+$EndComp
+$Comp
+L Device:R R2
+U 1 1 5C000002
+F 0 "R2" H 0 0 50  0000 C CNN
+F 1 "1k" H 0 0 50  0000 C CNN
+$EndComp
+$Comp
+L Device:C C1
+U 1 1 5C000003
+F 0 "C1" H 0 0 50  0000 C CNN
+F 1 "100n" H 0 0 50  0000 C CNN
+$EndComp
+$Comp
+L power:GND #PWR01
+U 1 1 5C000004
+F 0 "#PWR01" H 0 0 50  0001 C CNN
+$EndComp
+$EndSCHEMATC
+`
+
+// testDir writes files into a temporary directory, removed by the returned
+// function.
+func testDir(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "drone-kicad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestMatrixStatus(t *testing.T) {
+
+	tests := []struct {
+		cell   string
+		status string
+		ok     bool
+	}{
+		{"x", PART_FITTED, true},
+		{"Yes", PART_FITTED, true},
+		{"fit", PART_FITTED, true},
+		{"1", PART_FITTED, true},
+		{"DNP", PART_DNP, true},
+		{"", PART_REMOVED, true},
+		{"-", PART_REMOVED, true},
+		{"no", PART_REMOVED, true},
+		{"maybe", "", false},
+	}
+
+	for _, tt := range tests {
+		status, ok := matrixStatus(tt.cell)
+		if status != tt.status || ok != tt.ok {
+			t.Errorf("matrixStatus(%q) = %q, %v, want %q, %v", tt.cell, status, ok, tt.status, tt.ok)
+		}
+	}
+}
+
+func TestMatrixValue(t *testing.T) {
+
+	tests := []struct {
+		cell string
+		want interface{}
+	}{
+		{"true", true},
+		{"x", true},
+		{"No", false},
+		{"-", false},
+		{"null", nil},
+		{"5", 5.0},
+		{"0.5", 0.5},
+		{"ALL", "ALL"},
+	}
+
+	for _, tt := range tests {
+		if got := matrixValue(tt.cell); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("matrixValue(%q) = %#v, want %#v", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestReadMatrix(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		matrix   string
+		want     string   // Variants as JSON, when there is no error
+		err      string   // Expected error
+		problems []string // Expected problems with single rows
+	}{
+		{
+			name: "parts, content, overrides and options",
+			matrix: "variant,Lite,Full\n" +
+				"content,LITE,LITE || FULL\n" +
+				"R1,x,x\n" +
+				"R2,,dnp\n" +
+				"R2.value,,2k2\n" +
+				"# comment,whatever\n" +
+				"option.grb.all,true,\n" +
+				"option.wait,,5\n",
+			want: `[
+				{"name": "Lite", "content": "LITE", "parts": {"R1": "fitted", "R2": "removed"}, "options": {"grb": {"all": true}}},
+				{"name": "Full", "content": "LITE || FULL", "parts": {"R1": "fitted", "R2": "dnp"}, "overrides": {"R2": {"value": "2k2"}}, "options": {"wait": 5}}
+			]`,
+		},
+		{
+			name:   "short rows leave the cells empty",
+			matrix: "variant,A,B\nR1,x\n",
+			want:   `[{"name": "A", "parts": {"R1": "fitted"}}, {"name": "B", "parts": {"R1": "removed"}}]`,
+		},
+		{
+			name:   "unknown reference",
+			matrix: "variant,A\nR3,x\nLED100,x\nC1,maybe\n",
+			want:   `[{"name": "A"}]`,
+			problems: []string{
+				`matrix.csv:2: R3 is not in the schematic, did you mean "R1"?`,
+				`matrix.csv:3: LED100 is not in the schematic`,
+				`matrix.csv:4: C1: "maybe" is not x, dnp or empty`,
+			},
+		},
+		{
+			name:   "no variant columns",
+			matrix: "variant\nR1\n",
+			err:    "matrix.csv: no variant columns",
+		},
+		{
+			name:   "empty variant name",
+			matrix: "variant,A,\nR1,x,x\n",
+			err:    "matrix.csv:1: empty variant name",
+		},
+	}
+
+	for _, tt := range tests {
+		dir, remove := testDir(t, map[string]string{"board.sch": testSchematic, "matrix.csv": tt.matrix})
+		cwd, _ := os.Getwd()
+		os.Chdir(dir)
+
+		var problems []string
+		variants, err := readMatrix("matrix.csv", "board.sch", &problems)
+
+		os.Chdir(cwd)
+		remove()
+
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !sameProblems(problems, tt.problems) {
+			t.Errorf("%s: problems %q, want %q", tt.name, problems, tt.problems)
+		}
+		got, _ := json.Marshal(variants)
+		if want := jsonTree(t, tt.want); !reflect.DeepEqual(jsonTree(t, string(got)), want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandMatrices(t *testing.T) {
+
+	dir, remove := testDir(t, map[string]string{
+		"board.sch":  testSchematic,
+		"matrix.csv": "variant,Lite,Full\nR1,x,dnp\n",
+	})
+	defer remove()
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	var problems []string
+	settings := `{"projects": [{"main": "board", "matrix": "matrix.csv", "variants": [{"name": "Full", "content": "FULL"}]}]}`
+	got := expandMatrices(jsonTree(t, settings), &problems)
+
+	want := `{"projects": [{"main": "board", "matrix": "matrix.csv", "variants": [
+		{"name": "Full", "content": "FULL"},
+		{"name": "Lite", "parts": {"R1": "fitted"}}
+	]}]}`
+	if !reflect.DeepEqual(got, jsonTree(t, want)) {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	if want := []string{"matrix.csv: variant Full is also defined in projects[0].variants"}; !sameProblems(problems, want) {
+		t.Errorf("problems %q, want %q", problems, want)
+	}
+}
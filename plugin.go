@@ -3,12 +3,12 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/user"
 	"path"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,8 +21,12 @@ const (
 	grb_script = "/bin/ci-scripts/export_grb.py"
 	tag_script = "/bin/ci-scripts/tag_board.py"
 	dlf_script = "/bin/ci-scripts/delete_footprints.py"
-	ftr_script = "/bin/ci-scripts/footprints_to_remove.sh"
 	svg_script = "/bin/PcbDraw/pcbdraw.py"
+	ovr_script = "/bin/drone-kicad-scripts/apply_overrides.py"
+	drc_script = "/bin/drone-kicad-scripts/run_drc.py"
+	erc_script = "/bin/drone-kicad-scripts/run_erc.py"
+	zon_script = "/bin/drone-kicad-scripts/refill_zones.py"
+	plt_script = "/bin/drone-kicad-scripts/plot_gerbers.py"
 )
 
 const (
@@ -49,17 +53,31 @@ type (
 
 	// GerberLayers defines the options for exporting Gerber files
 	GerberLayers struct {
-		All      bool `json:"all"`
-		Protel   bool `json:"protel"`
-		Fcu      bool `json:"fcu"`
-		Bcu      bool `json:"bcu"`
-		Fmask    bool `json:"fmask"`
-		Bmask    bool `json:"bmask"`
-		Fsilks   bool `json:"fsilks"`
-		Bsilks   bool `json:"bsilks"`
-		Edgecuts bool `json:"edgecuts"`
-		Drl      bool `json:"drl"`
-		Splitth  bool `json:"splitth"`
+		All      bool                   `json:"all"`
+		Protel   bool                   `json:"protel"`
+		Fcu      bool                   `json:"fcu"`
+		Bcu      bool                   `json:"bcu"`
+		Fmask    bool                   `json:"fmask"`
+		Bmask    bool                   `json:"bmask"`
+		Fsilks   bool                   `json:"fsilks"`
+		Bsilks   bool                   `json:"bsilks"`
+		Edgecuts bool                   `json:"edgecuts"`
+		Drl      bool                   `json:"drl"`
+		Splitth  bool                   `json:"splitth"`
+		Layers   []string               `json:"layers"` // Layer names or globs among the enabled layers, e.g. In*.Cu, instead of the booleans
+		Plot     map[string]PlotOptions `json:"plot"`   // Plot options by layer name or glob
+	}
+
+	// PlotOptions defines how a gerber layer is plotted. Options left out
+	// keep the KiCad defaults.
+	PlotOptions struct {
+		References   *bool `json:"references"`   // Plot footprint references, on by default
+		Values       *bool `json:"values"`       // Plot footprint values, on by default
+		Edgecuts     *bool `json:"edgecuts"`     // Plot the board outline on the layer
+		Negative     *bool `json:"negative"`     // Plot negative
+		Mirror       *bool `json:"mirror"`       // Plot mirrored
+		Subtractmask *bool `json:"subtractmask"` // Remove silkscreen from the mask openings
+		Tented       *bool `json:"tented"`       // Cover vias with solder mask
 	}
 
 	// Tags defines wich tags to add to the board
@@ -72,24 +90,75 @@ type (
 		Variant bool `json:"variant"`
 	}
 
+	// Check defines a design rule check and the violations failing the
+	// build, written as a boolean alone or as an object
+	Check struct {
+		Enabled bool   `json:"enabled"` // Run the check
+		Fail    string `json:"fail"`    // Lowest severity failing the build: error (default), warning or never
+		Allow   int    `json:"allow"`   // Failing violations tolerated
+	}
+
+	// Zones defines how copper zone fills are handled, written as a
+	// boolean alone or as an object
+	Zones struct {
+		Refill bool `json:"refill"` // Refill every zone before checking and exporting the board
+		Check  bool `json:"check"`  // Fail when the fills saved in the board differ from the refilled ones
+	}
+
+	// Fab defines the capabilities of a board manufacturer, in
+	// millimetres, and the gerber options it expects. Zero is no limit.
+	Fab struct {
+		Track   float64 `json:"track"`   // Minimum track width
+		Space   float64 `json:"space"`   // Minimum clearance
+		Drill   float64 `json:"drill"`   // Minimum drill diameter
+		Annular float64 `json:"annular"` // Minimum annular ring
+		Width   float64 `json:"width"`   // Maximum board width
+		Height  float64 `json:"height"`  // Maximum board height
+		Layers  int     `json:"layers"`  // Maximum copper layers
+		Protel  bool    `json:"protel"`  // Protel filename extensions
+		Splitth bool    `json:"splitth"` // Split plated/non-plated through holes
+	}
+
+	// FieldRule requires symbol fields of the parts it applies to. A part
+	// must match one of the refs and one of the symbols patterns, when set.
+	FieldRule struct {
+		Refs    []string            `json:"refs"`    // Reference patterns, e.g. R[0-9]* or C[0-9]*, every part if empty
+		Symbols []string            `json:"symbols"` // Library symbol patterns, e.g. Device:R*, every part if empty
+		Require []string            `json:"require"` // Fields that must not be empty
+		Values  map[string][]string `json:"values"`  // Allowed values by field, each key of the variant field checked alone
+		Dnp     bool                `json:"dnp"`     // Also apply to DNP parts, only fitted parts otherwise
+	}
+
 	// Options for projects
 	ProjectOptions struct {
-		Sch  bool         // Generate Schematic (pdf)
-		Bom  bool         // Generate BOM xml
-		Grb  GerberLayers // Gerber layers enabled
-		Svg  bool         // Generate SVG output
-		Tags Tags         // Tags enabled
-		Pcb  bool         // Export PCB file
-		Wait int          // Delay before variant generation (allows Pcbnew to fully load)
+		Sch    bool         `json:"sch"`    // Generate Schematic (pdf)
+		Bom    bool         `json:"bom"`    // Generate BOM xml
+		Grb    GerberLayers `json:"grb"`    // Gerber layers enabled
+		Svg    bool         `json:"svg"`    // Generate SVG output
+		Tags   Tags         `json:"tags"`   // Tags enabled
+		Pcb    bool         `json:"pcb"`    // Export PCB file
+		Wait   int          `json:"wait"`   // Delay before variant generation (allows Pcbnew to fully load)
+		Drc    Check        `json:"drc"`    // Run the design rule check on the board
+		Erc    Check        `json:"erc"`    // Run the electrical rule check on the schematic
+		Fields []FieldRule  `json:"fields"` // Fields required on the parts of the BOM
+		Zones  Zones        `json:"zones"`  // Refill the zones of the board
+		Fab    string       `json:"fab"`    // Fab making the board, checked against its capabilities
 	}
 
-	// Options for variants
+	// Options for variants, inherited from the project options
 	VariantOptions struct {
-		Grb  GerberLayers // Gerber layers enabled
-		Svg  bool         // Generate SVG output
-		Tags Tags         // Tags enabled
-		Pcb  bool         // Export PCB file
-		Wait int          // Delay before variant generation (allows Pcbnew to fully load)
+		Sch    bool         `json:"sch"`    // Generate variant schematic (pdf), unfitted parts marked DNP
+		Bom    bool         `json:"bom"`    // Generate variant BOM (csv)
+		Grb    GerberLayers `json:"grb"`    // Gerber layers enabled
+		Svg    bool         `json:"svg"`    // Generate SVG output
+		Tags   Tags         `json:"tags"`   // Tags enabled
+		Pcb    bool         `json:"pcb"`    // Export PCB file
+		Wait   int          `json:"wait"`   // Delay before variant generation (allows Pcbnew to fully load)
+		Drc    Check        `json:"drc"`    // Run the design rule check on the variant board
+		Erc    Check        `json:"erc"`    // Run the electrical rule check on the variant schematic
+		Fields []FieldRule  `json:"fields"` // Fields required on the parts of the variant BOM
+		Zones  Zones        `json:"zones"`  // Refill the zones of the variant board, removed parts change them
+		Fab    string       `json:"fab"`    // Fab making the variant board
 		//Brd	bool // Generate PCB plot (pdf)
 		//Lyr	bool // Generate plot for each layer (pdf)
 		//3d	bool // Generate plot of 3D view (png)
@@ -97,26 +166,38 @@ type (
 
 	// Dependencies defines project dependencies to be cloned
 	Dependencies struct {
-		Libraries  []string `json:"libraries"`  // External libraries
-		Footprints []string `json:"footprints"` // External footprints
-		Modules3d  []string `json:"modules3d"`  // External 3D models
-		Basedir    string   `json:"basedir"`    // Base directory
-		Templates  []string `json:"templates"`  // External templates
-		Svglibs    []string `json:"svglibs"`    // External SVG models
-		Svglibdirs []string `json:"svglibdirs"` // SVG lib folder to pass to the svg generator
+		Libraries  []Dependency `json:"libraries"`  // External libraries
+		Footprints []Dependency `json:"footprints"` // External footprints
+		Modules3d  []Dependency `json:"modules3d"`  // External 3D models
+		Basedir    string       `json:"basedir"`    // Base directory
+		Templates  []Dependency `json:"templates"`  // External templates
+		Svglibs    []Dependency `json:"svglibs"`    // External SVG models
+		Svglibdirs []string     `json:"svglibdirs"` // SVG lib folder to pass to the svg generator
+	}
+
+	// Dependency defines a library source, written as its URL alone or as
+	// an object
+	Dependency struct {
+		URL    string `json:"url"`    // Repository or archive URL, or local path
+		Ref    string `json:"ref"`    // Tag, branch or full commit sha of a repository, the default branch if empty
+		Type   string `json:"type"`   // git, path or archive, guessed from the URL if empty
+		Sha256 string `json:"sha256"` // Checksum of an archive
 	}
 
 	// Commit handles commit information
 	Commit struct {
-		Tag string // tag if tag event
-		Sha string // commit sha
+		Tag    string // tag if tag event
+		Sha    string // commit sha
+		Before string // previous commit sha
 	}
 
 	// Variant defines a varaint in the project
 	Variant struct {
-		Name    string
-		Content string
-		Options VariantOptions
+		Name      string                       `json:"name"`
+		Content   string                       `json:"content"`   // Variant expression, e.g. (USB && !BATTERY) || DEV
+		Parts     map[string]string            `json:"parts"`     // Explicit status by reference (fitted, removed or dnp)
+		Overrides map[string]map[string]string `json:"overrides"` // Field values by reference (value, footprint or any field)
+		Options   VariantOptions               `json:"options"`
 	}
 
 	Project struct {
@@ -125,50 +206,153 @@ type (
 		Client       Client         `json:"client"`       // Enterprise client code
 		Dependencies Dependencies   `json:"dependencies"` // Projects dependencies
 		Variants     []Variant      `json:"variants"`     // Project variants
+		Matrix       string         `json:"matrix"`       // CSV file defining more variants
 		Options      ProjectOptions `json:"options"`      // Project options
 	}
 
 	// Plugin defines the KiCad plugin parameters
 	Plugin struct {
-		Projects []Project // Projects configuration
-		Netrc    Netrc     // Authentication
-		Commit   Commit    // Commit information
+		Projects       []Project      // Projects configuration
+		Netrc          Netrc          // Authentication given by the CI
+		Credentials    Credentials    // Authentication of dependencies
+		Commit         Commit         // Commit information
+		ChangedOnly    bool           // Only build projects changed since the previous commit
+		FullBuildOnTag bool           // Build all projects on tags, even with ChangedOnly
+		LockMode       string         // How the dependency lock is used: auto, frozen, update or off
+		Fetch          Fetch          // How dependencies are fetched
+		LibTables      bool           // Add the fetched libraries to the KiCad library tables
+		Preflight      bool           // Check that symbols, footprints and 3D models resolve before building
+		Consistency    bool           // Check that the schematic and the board match before building
+		Sarif          string         // File the findings of the checks are written to as SARIF, none if empty
+		Junit          string         // File the steps and checks are written to as JUnit XML, none if empty
+		Fabs           map[string]Fab // Fab presets by name
+		Profile        *Profile       // Profile matching the build event, if any
+		Signing        Signing        // Key signing release packages
 	}
 )
 
+// short returns the first 8 characters of the commit sha tagging the
+// outputs, or "dummy" when the sha is unknown.
+func (c Commit) short() string {
+	if len(c.Sha) > 7 {
+		return c.Sha[0:8]
+	} else if len(c.Sha) > 0 {
+		return c.Sha
+	}
+	return "dummy"
+}
+
 func (p Plugin) Exec() error {
 
-	err := writeNetrc(p.Netrc.Machine, p.Netrc.Login, p.Netrc.Password)
+	if p.Profile != nil && p.Profile.Skip {
+		fmt.Println("profile skips this build")
+		return nil
+	}
+
+	cleanup, err := setupAuth(p.Credentials, p.Netrc)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
 
-	var cmds []*exec.Cmd
+	projects := p.Projects
+	if p.ChangedOnly {
+		projects = p.changedProjects()
+	}
 
-	for _, project := range p.Projects {
+	// The lock covers the dependencies of every project, built or not
+	lock, err := lockDependencies(p.Projects, p.LockMode)
+	if err != nil {
+		return err
+	}
 
-		if project.Dependencies.Basedir == "" {
-			project.Dependencies.Basedir = "/usr/share/kicad"
+	// Dependencies shared by several projects are fetched once
+	jobs, err := fetchJobs(projects, lock)
+	if err != nil {
+		return err
+	}
+	if err := fetchDependencies(jobs, p.Fetch); err != nil {
+		return err
+	}
+	if p.Fetch.Only {
+		fmt.Printf("fetched %d dependencies\n", len(jobs))
+		return nil
+	}
+	if p.LibTables {
+		if err := writeLibTables(jobs); err != nil {
+			return err
 		}
+	}
+	// Findings of the checks and outcome of the steps, written however the
+	// build ends
+	results := &Results{}
+	if p.Sarif != "" {
+		defer func() {
+			if err := results.writeSARIF(p.Sarif); err != nil {
+				fmt.Printf("%s: %s\n", p.Sarif, err)
+			}
+		}()
+	}
+	if p.Junit != "" {
+		defer func() {
+			if err := results.writeJUnit(p.Junit); err != nil {
+				fmt.Printf("%s: %s\n", p.Junit, err)
+			}
+		}()
+	}
 
-		for _, dep := range project.Dependencies.Libraries {
-			cmds = append(cmds, commandClone(dep, DEP_TYPE_LIB, project.Dependencies.Basedir))
+	if p.Preflight {
+		if err := preflightProjects(projects, results); err != nil {
+			return err
 		}
-
-		for _, dep := range project.Dependencies.Footprints {
-			cmds = append(cmds, commandClone(dep, DEP_TYPE_PRETTY, project.Dependencies.Basedir))
+	}
+	// Variants rely on references matching between schematic and board
+	if p.Consistency {
+		if err := checkConsistency(projects, results); err != nil {
+			return err
 		}
+	}
+	// Incomplete BOMs hold up assembly orders
+	if err := checkFields(projects, results); err != nil {
+		return err
+	}
+	if err := checkFabs(projects, p.Fabs, results); err != nil {
+		return err
+	}
 
-		for _, dep := range project.Dependencies.Modules3d {
-			cmds = append(cmds, commandClone(dep, DEP_TYPE_3D, project.Dependencies.Basedir))
-		}
+	known, err := readBaseline()
+	if err != nil {
+		return err
+	}
 
-		for _, dep := range project.Dependencies.Templates {
-			cmds = append(cmds, commandClone(dep, DEP_TYPE_TEMPLATE, project.Dependencies.Basedir))
+	// Steps are reported under the output name of their project or variant
+	var steps []step
+	var suite string
+	// Commands with nothing to do, such as gerbers without layers, are nil
+	add := func(name string, cmd *exec.Cmd) {
+		if cmd != nil {
+			steps = append(steps, step{Suite: suite, Name: name, Cmd: cmd})
 		}
+	}
+	// Files written by the plugin itself are steps too, so that nothing is
+	// written once a step failed
+	do := func(name string, run func() error) {
+		steps = append(steps, step{Suite: suite, Name: name, Run: run})
+	}
+	// Gates check the report of their command and stop the build on failure
+	gate := func(cmd *exec.Cmd, kind string, check Check, source string, report string) {
+		steps = append(steps, step{Suite: suite, Name: kind, Cmd: cmd, Gate: func() error {
+			return checkReport(kind, check, source, report, known.accepted(kind, report), results)
+		}})
+	}
 
-		for _, dep := range project.Dependencies.Svglibs {
-			cmds = append(cmds, commandClone(dep, DEP_TYPE_SVG, project.Dependencies.Basedir))
+	for _, project := range projects {
+
+		project := project
+		start := len(steps)
+		suite = path.Base(project.Main)
+		if project.Dependencies.Basedir == "" {
+			project.Dependencies.Basedir = "/usr/share/kicad"
 		}
 
 		var svg_lib_dirs []string
@@ -178,81 +362,212 @@ func (p Plugin) Exec() error {
 			}
 		}
 
+		// Check the schematic and the board before anything is generated
+		if project.Options.Erc.Enabled {
+			report := outputPath(project.Main, "", "ERC", ".erc")
+			gate(commandERC(project.Main, report, project.Options.Wait), CHECK_ERC, project.Options.Erc, project.Main+".sch", report)
+		}
+		if project.Options.Zones.Refill || project.Options.Zones.Check {
+			add("zones", commandZones(project.Main+".kicad_pcb", project.Options.Zones))
+		}
+		if project.Options.Drc.Enabled {
+			report := outputPath(project.Main, "", "DRC", ".rpt")
+			gate(commandDRC(project.Main, "", report, project.Options.Wait), CHECK_DRC, project.Options.Drc, project.Main+".kicad_pcb", report)
+		}
+
 		// Export schematic
 		if project.Options.Sch {
-			cmds = append(cmds, commandSchematic(project))
+			add("schematic", commandSchematic(project.Main, project.Options.Wait))
 		}
 
 		// Export BOM (xml)
 		if project.Options.Bom {
-			cmds = append(cmds, commandBOM(project))
+			add("bom", commandBOM(project.Main, project.Options.Wait))
+		}
+
+		var sch Schematic
+		if len(project.Variants) > 0 {
+			sch, err = readSchematic(project.Main + ".sch")
+			if err != nil {
+				return err
+			}
 		}
 
 		// Process each variant
 		for _, variant := range project.Variants {
 
+			suite = path.Base(project.Main) + "_" + variant.Name
+			variant := variant
+			parts, err := variantParts(sch, variant)
+			if err != nil {
+				return err
+			}
+			do("variant report", func() error {
+				return writeVariantReport(outputPath(project.Main, variant.Name, "VARIANT", ".csv"), variant.Name, parts)
+			})
+
 			// Create a variant PCB file for each variant
-			cmds = append(cmds, commandVariant(variant, project))
+			add("variant board", commandVariant(variant, project, parts))
+
+			// Apply value and footprint overrides
+			if len(variant.Overrides) > 0 {
+				add("overrides", commandOverrides(project, variant.Name, parts))
+			}
+
+			// Removed and replaced footprints change the fills, saved ones
+			// are never current
+			if variant.Options.Zones.Refill {
+				add("zones", commandZones(project.Main+"_"+variant.Name+".kicad_pcb", Zones{Refill: true}))
+			}
+
+			// The variant board is what the fab makes
+			if variant.Options.Fab != "" {
+				do("fab", func() error {
+					return checkVariantFab(project, variant, p.Fabs, results)
+				})
+			}
+
+			// Check the variant board before exporting it
+			if variant.Options.Drc.Enabled {
+				report := outputPath(project.Main, variant.Name, "DRC", ".rpt")
+				gate(commandDRC(project.Main, variant.Name, report, variant.Options.Wait), CHECK_DRC, variant.Options.Drc, project.Main+"_"+variant.Name+".kicad_pcb", report)
+			}
+
+			// Export variant schematic, unfitted parts marked DNP
+			if variant.Options.Sch || variant.Options.Erc.Enabled {
+				dir := path.Dir(outputPath(project.Main, variant.Name, "VARIANT", ""))
+				name := variantSchematic(sch, variant.Name, dir)
+				do("variant schematic", func() error {
+					return writeVariantSchematic(sch, variant.Name, parts, dir)
+				})
+				if variant.Options.Erc.Enabled {
+					report := outputPath(project.Main, variant.Name, "ERC", ".erc")
+					gate(commandERC(name, report, variant.Options.Wait), CHECK_ERC, variant.Options.Erc, name+".sch", report)
+				}
+				if variant.Options.Sch {
+					add("schematic", commandSchematic(name, variant.Options.Wait))
+				}
+			}
+
+			// Export variant BOM (csv)
+			if variant.Options.Bom {
+				do("bom", func() error {
+					return writeVariantBOM(outputPath(project.Main, variant.Name, "BOM", ".csv"), parts)
+				})
+			}
 
 			// Tag board
 			if variant.Options.Tags.Sed {
-				cmds = append(cmds, commandSed("\\$commit\\$", p.Commit.Sha[0:8], project.Main, variant.Name))
+				add("sed $commit$", commandSed("\\$commit\\$", p.Commit.short(), project.Main, variant.Name))
 				if len(p.Commit.Tag) > 0 {
-					cmds = append(cmds, commandSed("\\$tag\\$", p.Commit.Tag, project.Main, variant.Name))
+					add("sed $tag$", commandSed("\\$tag\\$", p.Commit.Tag, project.Main, variant.Name))
 				} else {
-					cmds = append(cmds, commandSed("\\$tag\\$", "\"\"", project.Main, variant.Name))
+					add("sed $tag$", commandSed("\\$tag\\$", "\"\"", project.Main, variant.Name))
 				}
 				year, month, day := time.Now().Date()
 				date := fmt.Sprintf("%d/%d/%d", day, month, year)
-				cmds = append(cmds, commandSed("\\$date\\$", date, project.Main, variant.Name))
+				add("sed $date$", commandSed("\\$date\\$", date, project.Main, variant.Name))
 			} else {
-				cmds = append(cmds, commandTag(p.Commit, project.Main, variant.Name, variant.Options.Tags))
+				add("tags", commandTag(p.Commit, project.Main, variant.Name, variant.Options.Tags))
 			}
 
 			// Export PCB
 			if variant.Options.Pcb {
-				cmds = append(cmds, commandCopyPcb(project.Main, variant.Name))
+				add("pcb", commandCopyPcb(project.Main, variant.Name))
 			}
 
 			// Export SVG
 			if variant.Options.Svg {
-				cmds = append(cmds, commandSVG(project.Main, variant.Name, svg_lib_dirs))
+				add("svg", commandSVG(project.Main, variant.Name, svg_lib_dirs))
 			}
 
 			// Export Gerbers
-			cmds = append(cmds, commandGerber(project.Main, variant.Name, variant.Options.Grb))
+			add("gerbers", commandGerber(project.Main, variant.Name, variant.Options.Grb))
 		}
+		suite = path.Base(project.Main)
 
 		// Tag board
 		if project.Options.Tags.Sed {
-			cmds = append(cmds, commandSed("\\$commit\\$", p.Commit.Sha[0:8], project.Main, ""))
+			add("sed $commit$", commandSed("\\$commit\\$", p.Commit.short(), project.Main, ""))
 			if len(p.Commit.Tag) > 0 {
-				cmds = append(cmds, commandSed("\\$tag\\$", p.Commit.Tag, project.Main, ""))
+				add("sed $tag$", commandSed("\\$tag\\$", p.Commit.Tag, project.Main, ""))
 			} else {
-				cmds = append(cmds, commandSed("\\$tag\\$", "\"\"", project.Main, ""))
+				add("sed $tag$", commandSed("\\$tag\\$", "\"\"", project.Main, ""))
 			}
 			year, month, day := time.Now().Date()
 			date := fmt.Sprintf("%d/%d/%d", day, month, year)
-			cmds = append(cmds, commandSed("\\$date\\$", date, project.Main, ""))
+			add("sed $date$", commandSed("\\$date\\$", date, project.Main, ""))
 		} else {
-			cmds = append(cmds, commandTag(p.Commit, project.Main, "", project.Options.Tags))
+			add("tags", commandTag(p.Commit, project.Main, "", project.Options.Tags))
 		}
 
 		// Export PCB
 		if project.Options.Pcb {
-			cmds = append(cmds, commandCopyPcb(project.Main, ""))
+			add("pcb", commandCopyPcb(project.Main, ""))
 		}
 
 		// Export Gerbers
-		cmds = append(cmds, commandGerber(project.Main, "", project.Options.Grb))
+		add("gerbers", commandGerber(project.Main, "", project.Options.Grb))
 
 		// Export SVG
 		if project.Options.Svg {
-			cmds = append(cmds, commandSVG(project.Main, "", svg_lib_dirs))
+			add("svg", commandSVG(project.Main, "", svg_lib_dirs))
 		}
+
+		// KiCad finds the dependencies through its path variables
+		for _, step := range steps[start:] {
+			if step.Cmd == nil {
+				continue
+			}
+			if step.Cmd.Env == nil {
+				step.Cmd.Env = os.Environ()
+			}
+			step.Cmd.Env = append(step.Cmd.Env, kicadEnv(project.Dependencies.Basedir)...)
+		}
+	}
+
+	if err := runSteps(steps, results); err != nil {
+		return err
+	}
+
+	if p.Profile != nil && p.Profile.Package {
+		return p.release()
+	}
+
+	return nil
+}
+
+// release packages the outputs, and signs the package and its checksums
+// when the profile asks for it.
+func (p Plugin) release() error {
+
+	name := p.Commit.Tag
+	if name == "" {
+		name = p.Commit.short()
+	}
+	archive, err := writePackage(name)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("packaged %s\n", archive)
 
-	// execute all commands in batch mode.
+	if !p.Profile.Sign {
+		return nil
+	}
+	if p.Signing.Key == "" {
+		return fmt.Errorf("the profile signs releases but no signing_key is set")
+	}
+	home, err := ioutil.TempDir("", "drone-kicad-gnupg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+
+	return runCommands(commandsSign(p.Signing, home, archive, path.Join(path.Dir(archive), "SHA256SUMS")))
+}
+
+// runCommands executes all commands in batch mode.
+func runCommands(cmds []*exec.Cmd) error {
 	for _, cmd := range cmds {
 		if cmd != nil {
 			cmd.Stdout = os.Stdout
@@ -265,10 +580,59 @@ func (p Plugin) Exec() error {
 			}
 		}
 	}
-
 	return nil
 }
 
+// step is a command of the build, reported as a test case
+type step struct {
+	Suite string       // Output name of the project or variant
+	Name  string       // What the command does
+	Cmd   *exec.Cmd    // Command
+	Run   func() error // Work done by the plugin itself, instead of a command
+	Gate  func() error // Check of the command outcome, if any
+}
+
+// runSteps executes the steps in order until one fails, recording their
+// outcome, duration and output in the results. Steps after a failure are
+// recorded as skipped.
+func runSteps(steps []step, results *Results) error {
+
+	var failed error
+	for _, s := range steps {
+		outcome := StepResult{Suite: s.Suite, Name: s.Name}
+		if failed != nil {
+			outcome.Skipped = true
+			results.Steps = append(results.Steps, outcome)
+			continue
+		}
+
+		var stdout, stderr bytes.Buffer
+		var err error
+		start := time.Now()
+		if s.Cmd != nil {
+			s.Cmd.Stdout = io.MultiWriter(os.Stdout, &stdout)
+			s.Cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+			trace(s.Cmd)
+			err = s.Cmd.Run()
+		} else {
+			err = s.Run()
+		}
+		if err == nil && s.Gate != nil {
+			err = s.Gate()
+		}
+		outcome.Duration = time.Since(start)
+		outcome.Stdout = stdout.String()
+		outcome.Stderr = stderr.String()
+		if err != nil {
+			outcome.Failure = err.Error()
+			failed = err
+		}
+		results.Steps = append(results.Steps, outcome)
+	}
+
+	return failed
+}
+
 func commandCopyPcb(pjtname string, variant string) *exec.Cmd {
 
 	var board []string
@@ -295,50 +659,79 @@ func commandCopyPcb(pjtname string, variant string) *exec.Cmd {
 	)
 }
 
-func commandVariant(variant Variant, project Project) *exec.Cmd {
+func commandVariant(variant Variant, project Project, parts []PartStatus) *exec.Cmd {
 
-	var schematic []string
-	schematic = append(schematic, project.Main, ".sch")
-
-	var board []string
-	board = append(board, project.Main, ".kicad_pcb")
+	var remove []string
+	for _, part := range parts {
+		if part.Status == PART_REMOVED {
+			remove = append(remove, part.Ref+"\n")
+		}
+	}
 
 	var options []string
+	options = append(options, "-u")
+	options = append(options, dlf_script)
+	options = append(options, "--brd")
 	options = append(options, project.Main)
-	if len(variant.Content) > 0 {
-		options = append(options, strings.Split(variant.Content, ",")...)
+	options = append(options, "--footprints")
+	options = append(options, strings.Join(remove, ""))
+	options = append(options, "--variant")
+	options = append(options, variant.Name)
+	if variant.Options.Wait > 0 {
+		options = append(options, "--wait_init", strconv.Itoa(variant.Options.Wait))
 	}
 
-	fpToRemove := exec.Command(
-		ftr_script,
+	return exec.Command(
+		pythonexec,
 		options...,
 	)
-	var stdout bytes.Buffer
-	fpToRemove.Stdout = &stdout
-	err := fpToRemove.Run()
-	if err != nil {
-		fmt.Printf("%s", err)
-	}
-	outStr := string(stdout.Bytes())
-
-	var options2 []string
-	options2 = append(options2, "-u")
-	options2 = append(options2, dlf_script)
-	options2 = append(options2, "--brd")
-	options2 = append(options2, project.Main)
-	options2 = append(options2, "--footprints")
-	options2 = append(options2, outStr)
-	options2 = append(options2, "--variant")
-	options2 = append(options2, variant.Name)
-	if variant.Options.Wait > 0 {
-		options2 = append(options2, "--wait_init", strconv.Itoa(variant.Options.Wait))
-	} else if project.Options.Wait > 0 {
-		options2 = append(options2, "--wait_init", strconv.Itoa(project.Options.Wait))
+}
+
+func commandOverrides(project Project, variant string, parts []PartStatus) *exec.Cmd {
+
+	var options []string
+	options = append(options, "-u", ovr_script)
+	options = append(options, "--brd", strings.Join([]string{project.Main, "_", variant, ".kicad_pcb"}, ""))
+	options = append(options, "--libdir", path.Join(project.Dependencies.Basedir, "footprints"))
+	options = append(options, "--libdir", path.Dir(project.Main))
+	options = append(options, "--libdir", "/usr/share/kicad/modules")
+
+	// Removed parts are no longer on the variant board
+	for _, part := range parts {
+		if part.Status == PART_REMOVED {
+			continue
+		}
+		for _, field := range part.Overridden {
+			if strings.EqualFold(field, "value") {
+				options = append(options, "--value", part.Ref, part.Value)
+			} else if strings.EqualFold(field, "footprint") {
+				options = append(options, "--footprint", part.Ref, part.Footprint)
+			}
+		}
 	}
 
 	return exec.Command(
 		pythonexec,
-		options2...,
+		options...,
+	)
+}
+
+// commandZones refills the zones of a board, checking the saved fills
+// first if asked. A check alone leaves the board untouched.
+func commandZones(board string, zones Zones) *exec.Cmd {
+
+	var options []string
+	options = append(options, "-u", zon_script, "--brd", board)
+	if zones.Check {
+		options = append(options, "--check")
+	}
+	if zones.Refill {
+		options = append(options, "--save")
+	}
+
+	return exec.Command(
+		pythonexec,
+		options...,
 	)
 }
 
@@ -372,33 +765,32 @@ func commandSVG(pjtname string, variant string, svg_lib_dirs []string) *exec.Cmd
 	)
 }
 
-func commandClone(depurl string, deptype int, basedir string) *exec.Cmd {
-
-	if deptype == DEP_TYPE_LIB {
-		basedir = path.Join(basedir, "library")
-	} else if deptype == DEP_TYPE_PRETTY {
-		basedir = path.Join(basedir, "footprints")
-	} else if deptype == DEP_TYPE_3D {
-		basedir = path.Join(basedir, "modules/packages3d")
-	} else if deptype == DEP_TYPE_TEMPLATE {
-		basedir = path.Join(basedir, "template")
-	} else if deptype == DEP_TYPE_SVG {
-		basedir = path.Join(basedir, "svg-lib")
-	}
+// typedDependency is a dependency along with its DEP_TYPE_*
+type typedDependency struct {
+	Dependency
+	Type int
+	At   string // Settings path, e.g. libraries[0]
+}
 
-	err := os.MkdirAll(basedir, 0777)
-	if err != nil {
-		fmt.Println("Directory couldn't be created!")
+// list returns all the dependencies to fetch, in fetching order.
+func (d Dependencies) list() []typedDependency {
+	var deps []typedDependency
+	for _, group := range []struct {
+		deps []Dependency
+		typ  int
+		key  string
+	}{
+		{d.Libraries, DEP_TYPE_LIB, "libraries"},
+		{d.Footprints, DEP_TYPE_PRETTY, "footprints"},
+		{d.Modules3d, DEP_TYPE_3D, "modules3d"},
+		{d.Templates, DEP_TYPE_TEMPLATE, "templates"},
+		{d.Svglibs, DEP_TYPE_SVG, "svglibs"},
+	} {
+		for i, dep := range group.deps {
+			deps = append(deps, typedDependency{dep, group.typ, fmt.Sprintf("%s[%d]", group.key, i)})
+		}
 	}
-
-	var cmd []string
-	cmd = append(cmd, "cd", basedir, "&&", "git", "clone", depurl)
-
-	return exec.Command(
-		"/bin/sh",
-		"-c",
-		strings.Join(cmd, " "),
-	)
+	return deps
 }
 
 func commandSed(regex string, repl string, prjname string, variant string) *exec.Cmd {
@@ -425,15 +817,6 @@ func commandSed(regex string, repl string, prjname string, variant string) *exec
 func commandTag(c Commit, pjtname string, variant string, tags Tags) *exec.Cmd {
 
 	var options []string
-	var sha string
-	if len(c.Sha) > 7 {
-		sha = c.Sha[0:8]
-	} else if len(c.Sha) > 0 {
-		sha = c.Sha
-	} else {
-		sha = "dummy"
-	}
-
 	options = append(options, "-u", tag_script)
 
 	var board []string
@@ -443,7 +826,7 @@ func commandTag(c Commit, pjtname string, variant string, tags Tags) *exec.Cmd {
 		board = append(board, pjtname)
 	}
 	options = append(options, "--brd", strings.Join(board, ""))
-	options = append(options, "--commit", sha)
+	options = append(options, "--commit", c.short())
 	if len(variant) > 0 {
 		options = append(options, "--variant", variant)
 	} else {
@@ -518,6 +901,10 @@ func commandGerber(pjtname string, variant string, lyr GerberLayers) *exec.Cmd {
 	if lyr.Protel {
 		options = append(options, "--protel")
 	}
+	// Board, directory and naming options are shared with the plot script
+	if len(lyr.Layers) > 0 {
+		return commandPlot(options[2:], lyr)
+	}
 	if lyr.All {
 		options = append(options, "--all")
 		return exec.Command(
@@ -560,12 +947,74 @@ func commandGerber(pjtname string, variant string, lyr GerberLayers) *exec.Cmd {
 	}
 }
 
-func commandSchematic(project Project) *exec.Cmd {
+// commandPlot plots the gerbers of the layers selected by name, with their
+// plot options.
+func commandPlot(common []string, lyr GerberLayers) *exec.Cmd {
+
+	var options []string
+	options = append(options, "-u", plt_script)
+	options = append(options, common...)
+	for _, layer := range lyr.Layers {
+		options = append(options, "--layer", layer)
+	}
+	if lyr.Drl {
+		options = append(options, "--drl")
+	}
+
+	var patterns []string
+	for pattern := range lyr.Plot {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		plot := lyr.Plot[pattern]
+		for _, option := range []struct {
+			name  string
+			value *bool
+		}{
+			{"references", plot.References},
+			{"values", plot.Values},
+			{"edgecuts", plot.Edgecuts},
+			{"negative", plot.Negative},
+			{"mirror", plot.Mirror},
+			{"subtractmask", plot.Subtractmask},
+			{"tented", plot.Tented},
+		} {
+			if option.value != nil {
+				options = append(options, "--option", pattern, option.name, strconv.FormatBool(*option.value))
+			}
+		}
+	}
+
+	return exec.Command(
+		pythonexec,
+		options...,
+	)
+}
+
+// checkGerberLayers returns what is wrong with the layer patterns of the
+// gerber options.
+func checkGerberLayers(lyr GerberLayers) []string {
+	var problems []string
+	for i, pattern := range lyr.Layers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("layers[%d]: %s", i, err))
+		}
+	}
+	for pattern := range lyr.Plot {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("plot.%s: %s", pattern, err))
+		}
+	}
+	return problems
+}
+
+func commandSchematic(pjtname string, wait int) *exec.Cmd {
 
 	var options []string
-	options = append(options, "-u", sch_script, project.Main)
-	if project.Options.Wait > 0 {
-		options = append(options, strconv.Itoa(project.Options.Wait))
+	options = append(options, "-u", sch_script, pjtname)
+	if wait > 0 {
+		options = append(options, strconv.Itoa(wait))
 	}
 	var c = exec.Command(
 		pythonexec,
@@ -579,12 +1028,12 @@ func commandSchematic(project Project) *exec.Cmd {
 	return c
 }
 
-func commandBOM(project Project) *exec.Cmd {
+func commandBOM(pjtname string, wait int) *exec.Cmd {
 
 	var options []string
-	options = append(options, "-u", bom_script, project.Main)
-	if project.Options.Wait > 0 {
-		options = append(options, strconv.Itoa(project.Options.Wait))
+	options = append(options, "-u", bom_script, pjtname)
+	if wait > 0 {
+		options = append(options, strconv.Itoa(wait))
 	}
 	var c = exec.Command(
 		pythonexec,
@@ -604,29 +1053,14 @@ func trace(cmd *exec.Cmd) {
 	fmt.Fprintf(os.Stdout, "+ %s\n", strings.Join(cmd.Args, " "))
 }
 
-// helper function to write a netrc file. [From drone-git]
-func writeNetrc(machine, login, password string) error {
-	if machine == "" {
-		return nil
-	}
-	out := fmt.Sprintf(
-		netrcFile,
-		machine,
-		login,
-		password,
-	)
+// outputPath returns the path of an output file of a project or variant:
+// CI-BUILD/<name>[_<variant>]/<dir>/<name>[_<variant>]<ext>
+func outputPath(pjtname string, variant string, dir string, ext string) string {
 
-	home := "/root"
-	u, err := user.Current()
-	if err == nil {
-		home = u.HomeDir
+	name := path.Base(pjtname)
+	if len(variant) > 0 {
+		name = strings.Join([]string{name, "_", variant}, "")
 	}
-	path := filepath.Join(home, ".netrc")
-	return ioutil.WriteFile(path, []byte(out), 0600)
-}
 
-const netrcFile = `
-machine %s
-login %s
-password %s
-`
+	return strings.Join([]string{"CI-BUILD/", name, "/", dir, "/", name, ext}, "")
+}
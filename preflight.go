@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Finding is a problem found in a project file
+type Finding struct {
+	File     string // File holding the problem
+	Line     int    // Line in File, 0 if unknown
+	Check    string // Check finding it, e.g. missing-footprint
+	Message  string // What is wrong
+	Severity string // error or warning, error if empty
+	Baseline string // new, unchanged or absent for checks with a baseline
+	Passing  bool   // Reported without failing the build, e.g. below the check threshold
+}
+
+func (f Finding) String() string {
+	if f.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", f.File, f.Line, f.Message)
+	}
+	return fmt.Sprintf("%s: %s", f.File, f.Message)
+}
+
+// sortFindings orders findings by file and line.
+func sortFindings(findings []Finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return findings[i].File < findings[j].File
+		}
+		return findings[i].Line < findings[j].Line
+	})
+}
+
+var pathVariable = regexp.MustCompile(`\$\{([^}]+)\}|\$\(([^)]+)\)`)
+
+// resolver finds the symbols, footprints and 3D models of a project as
+// KiCad would: through the project and global library tables and the path
+// variables set for the build steps.
+type resolver struct {
+	dir        string              // Project directory
+	vars       map[string]string   // Path variables
+	symbols    map[string]libEntry // Symbol libraries by nickname
+	footprints map[string]libEntry // Footprint libraries by nickname
+	symbolSets map[string]map[string]bool
+}
+
+func newResolver(project Project) *resolver {
+
+	basedir := project.Dependencies.Basedir
+	if basedir == "" {
+		basedir = "/usr/share/kicad"
+	}
+	dir, err := filepath.Abs(path.Dir(project.Main))
+	if err != nil {
+		dir = path.Dir(project.Main)
+	}
+
+	r := &resolver{
+		dir:        dir,
+		vars:       map[string]string{"KIPRJMOD": dir},
+		symbolSets: make(map[string]map[string]bool),
+	}
+	for _, env := range kicadEnv(basedir) {
+		kv := strings.SplitN(env, "=", 2)
+		r.vars[kv[0]] = kv[1]
+	}
+	r.symbols = r.readTables(symTable)
+	r.footprints = r.readTables(fpTable)
+	return r
+}
+
+// readTables reads the global library table, or the KiCad template one,
+// then the project one, whose entries take precedence.
+func (r *resolver) readTables(name string) map[string]libEntry {
+	libs := make(map[string]libEntry)
+	global, err := readSexpr(path.Join(kicadConfigDir(), name))
+	if err != nil {
+		global, _ = readSexpr(path.Join("/usr/share/kicad/template", name))
+	}
+	local, _ := readSexpr(path.Join(r.dir, name))
+	for _, table := range []*Node{global, local} {
+		if table == nil {
+			continue
+		}
+		for _, lib := range table.Children("lib") {
+			entry := libEntry{childArg(lib, "name"), childArg(lib, "type"), childArg(lib, "uri")}
+			if entry.Name != "" {
+				libs[entry.Name] = entry
+			}
+		}
+	}
+	return libs
+}
+
+// childArg returns the first atom of the named child list, or "".
+func childArg(n *Node, name string) string {
+	if c := n.Child(name); c != nil {
+		return c.Arg(0)
+	}
+	return ""
+}
+
+// expand replaces the path variables of a library or model path and
+// makes it absolute, or returns the first undefined variable.
+func (r *resolver) expand(uri string) (string, string) {
+	var undefined string
+	uri = pathVariable.ReplaceAllStringFunc(uri, func(v string) string {
+		name := strings.Trim(v, "${}()")
+		if value, ok := r.vars[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if undefined == "" {
+			undefined = name
+		}
+		return v
+	})
+	if undefined == "" && !path.IsAbs(uri) {
+		uri = path.Join(r.dir, uri)
+	}
+	return uri, undefined
+}
+
+// library returns the path of the library of a Library:Name reference, or
+// a message telling why it isn't usable. Remote libraries are returned as
+// "", with no message.
+func (r *resolver) library(libs map[string]libEntry, table string, id string) (libEntry, string, string) {
+	i := strings.Index(id, ":")
+	if i < 0 {
+		return libEntry{}, "", fmt.Sprintf("%s: expected Library:Name", id)
+	}
+	entry, ok := libs[id[:i]]
+	if !ok {
+		return entry, "", fmt.Sprintf("%s: library %s is not in %s", id, id[:i], table)
+	}
+	if strings.Contains(entry.URI, "://") {
+		return entry, "", ""
+	}
+	file, undefined := r.expand(entry.URI)
+	if undefined != "" {
+		return entry, "", fmt.Sprintf("%s: library %s uses undefined variable %s", id, entry.Name, undefined)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return entry, "", fmt.Sprintf("%s: library %s not found at %s", id, entry.Name, file)
+	}
+	return entry, file, ""
+}
+
+// symbol returns what is wrong with a symbol reference, or "".
+func (r *resolver) symbol(id string) string {
+	entry, file, problem := r.library(r.symbols, symTable, id)
+	if file == "" {
+		return problem
+	}
+	names, ok := r.symbolSets[file]
+	if !ok {
+		names = readSymbolNames(file, entry.Type)
+		r.symbolSets[file] = names
+	}
+	if names != nil && !names[id[strings.Index(id, ":")+1:]] {
+		return fmt.Sprintf("%s: symbol not found in %s", id, file)
+	}
+	return ""
+}
+
+// footprint returns what is wrong with a footprint reference, or "".
+func (r *resolver) footprint(id string) string {
+	entry, dir, problem := r.library(r.footprints, fpTable, id)
+	if dir == "" || entry.Type != "KiCad" {
+		return problem
+	}
+	file := path.Join(dir, id[strings.Index(id, ":")+1:]+".kicad_mod")
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Sprintf("%s: footprint not found in %s", id, dir)
+	}
+	return ""
+}
+
+// model returns what is wrong with a 3D model path, or "".
+func (r *resolver) model(uri string) string {
+	file, undefined := r.expand(uri)
+	if undefined != "" {
+		return fmt.Sprintf("3D model %s: undefined variable %s", uri, undefined)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Sprintf("3D model %s: not found at %s", uri, file)
+	}
+	return ""
+}
+
+// readSymbolNames returns the symbols of a legacy or s-expression symbol
+// library, nil if it can't be read.
+func readSymbolNames(file string, libtype string) map[string]bool {
+
+	names := make(map[string]bool)
+	if libtype != "Legacy" {
+		lib, err := readSexpr(file)
+		if err != nil {
+			return nil
+		}
+		for _, symbol := range lib.Children("symbol") {
+			names[symbol.Arg(0)] = true
+		}
+		return names
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "DEF" {
+			names[strings.TrimPrefix(fields[1], "~")] = true
+		} else if len(fields) > 1 && fields[0] == "ALIAS" {
+			for _, alias := range fields[1:] {
+				names[alias] = true
+			}
+		}
+	}
+	return names
+}
+
+// preflight resolves the symbols and footprints of the schematic, the
+// footprints and 3D models of the board and the footprints of the variant
+// overrides, so that a missing library fails the build before any step
+// runs.
+func preflight(project Project) []Finding {
+
+	r := newResolver(project)
+	var findings []Finding
+	seen := make(map[Finding]bool)
+	add := func(file string, line int, check string, problem string) {
+		finding := Finding{File: file, Line: line, Check: check, Message: problem}
+		// Units and sheet instances repeat the same component
+		if problem != "" && !seen[finding] {
+			seen[finding] = true
+			findings = append(findings, finding)
+		}
+	}
+
+	sch := project.Main + ".sch"
+	if _, err := os.Stat(sch); err == nil {
+		schematic, err := readSchematic(sch)
+		if err != nil {
+			add(sch, 0, "schematic", err.Error())
+		}
+		for _, c := range schematic.Components {
+			if c.Symbol != "" {
+				add(c.File, c.Line, "missing-symbol", prefixRef(c.Ref, r.symbol(c.Symbol)))
+			}
+			if c.Footprint != "" && !c.IsPower() {
+				add(c.File, c.Line, "missing-footprint", prefixRef(c.Ref, r.footprint(c.Footprint)))
+			}
+		}
+	}
+
+	brd := project.Main + ".kicad_pcb"
+	if _, err := os.Stat(brd); err == nil {
+		board, err := readSexpr(brd)
+		if err != nil {
+			add(brd, 0, "board", err.Error())
+		} else {
+			for _, fp := range boardFootprints(board) {
+				if strings.Contains(fp.ID, ":") {
+					add(brd, fp.Line, "missing-footprint", prefixRef(fp.Ref, r.footprint(fp.ID)))
+				}
+				for _, model := range fp.Node.Children("model") {
+					add(brd, model.Line, "missing-model", prefixRef(fp.Ref, r.model(model.Arg(0))))
+				}
+			}
+		}
+	}
+
+	for _, variant := range project.Variants {
+		refs := make([]string, 0, len(variant.Overrides))
+		for ref := range variant.Overrides {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			for name, value := range variant.Overrides[ref] {
+				if !strings.EqualFold(name, "footprint") || value == "" {
+					continue
+				}
+				if problem := r.footprint(value); problem != "" {
+					add(project.Main, 0, "missing-footprint",
+						fmt.Sprintf("variant %s overrides %s.%s: %s", variant.Name, ref, name, problem))
+				}
+			}
+		}
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+func prefixRef(ref string, problem string) string {
+	if problem == "" || ref == "" {
+		return problem
+	}
+	return ref + ": " + problem
+}
+
+// preflightProjects runs the pre-flight check of every project, adds the
+// findings to the results and returns an error listing them.
+func preflightProjects(projects []Project, results *Results) error {
+	var findings []Finding
+	for _, project := range projects {
+		findings = append(findings, preflight(project)...)
+	}
+	results.add(findings...)
+	return findingsError("pre-flight check failed", findings)
+}
+
+// findingsError returns an error listing the findings, if any.
+func findingsError(title string, findings []Finding) error {
+	if len(findings) == 0 {
+		return nil
+	}
+	problems := make([]string, len(findings))
+	for i, finding := range findings {
+		problems[i] = finding.String()
+	}
+	return fmt.Errorf("%s, %d problems:\n  - %s", title, len(problems), strings.Join(problems, "\n  - "))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type (
+
+	// Profile adapts the build to the CI event that triggered it. The first
+	// profile matching the event and branch applies.
+	Profile struct {
+		Event   []string       `json:"event"`   // Build events (push, pull_request, tag...), any if empty
+		Branch  []string       `json:"branch"`  // Branch globs, any if empty
+		Skip    bool           `json:"skip"`    // Build nothing
+		Options ProjectOptions `json:"options"` // Options applied over every project and variant
+		Package bool           `json:"package"` // Package the outputs as a release archive
+		Sign    bool           `json:"sign"`    // Sign the release archive with the signing key
+	}
+
+	// Build describes the CI build being run
+	Build struct {
+		Event  string // Build event
+		Branch string // Target branch
+		Number string // Build number
+	}
+
+	// Signing holds the key used to sign release packages
+	Signing struct {
+		Key        string // ASCII armored private GPG key
+		Passphrase string // Passphrase of the key
+	}
+)
+
+// matchProfile returns the index of the first profile matching the build,
+// or -1.
+func matchProfile(profiles []Profile, build Build) int {
+	for i, profile := range profiles {
+		if len(profile.Event) > 0 && !containsFold(profile.Event, build.Event) {
+			continue
+		}
+		if len(profile.Branch) > 0 && !matchAny(profile.Branch, build.Branch) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyProfile merges the options of the profile matching the build over
+// the options of every project and variant, with the same null and false
+// semantics as inheritance.
+func applyProfile(tree interface{}, build Build, problems *[]string) interface{} {
+
+	settings, ok := tree.(map[string]interface{})
+	if !ok || settings["profiles"] == nil {
+		return tree
+	}
+
+	var profiles []Profile
+	if err := decodeTree(settings["profiles"], &profiles); err != nil {
+		*problems = append(*problems, fmt.Sprintf("profiles: %s", err))
+		return tree
+	}
+	i := matchProfile(profiles, build)
+	if i < 0 {
+		return tree
+	}
+	list, _ := settings["profiles"].([]interface{})
+	if i >= len(list) {
+		return tree
+	}
+	raw, _ := list[i].(map[string]interface{})
+	overlay, _ := raw["options"].(map[string]interface{})
+	if overlay == nil {
+		return tree
+	}
+
+	variantOverlay := make(map[string]interface{})
+	for _, key := range fieldNames(structKeys(reflect.TypeOf(VariantOptions{}))) {
+		if value, ok := overlay[key]; ok {
+			variantOverlay[key] = value
+		}
+	}
+
+	projects, _ := settings["projects"].([]interface{})
+	for _, p := range projects {
+		project, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		project["options"] = mergeTree(project["options"], overlay)
+		variants, _ := project["variants"].([]interface{})
+		for _, v := range variants {
+			if variant, ok := v.(map[string]interface{}); ok {
+				variant["options"] = mergeTree(variant["options"], variantOverlay)
+			}
+		}
+	}
+
+	return settings
+}
+
+// writePackage archives the outputs of the build in
+// CI-BUILD/release/<name>.zip with a SHA256SUMS file listing the checksum
+// of every packaged file and of the archive itself.
+func writePackage(name string) (string, error) {
+
+	root := "CI-BUILD"
+	dir := path.Join(root, "release")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+
+	var files []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if file == dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	archive := path.Join(dir, name+".zip")
+	out, err := os.Create(archive)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	var sums []string
+	w := zip.NewWriter(out)
+	for _, file := range files {
+		rel, _ := filepath.Rel(root, file)
+		sum, err := addToZip(w, file, path.Join(name, filepath.ToSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		sums = append(sums, fmt.Sprintf("%s  %s", sum, filepath.ToSlash(rel)))
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	sum, err := sha256File(archive)
+	if err != nil {
+		return "", err
+	}
+	sums = append(sums, fmt.Sprintf("%s  %s", sum, path.Base(archive)))
+
+	err = ioutil.WriteFile(path.Join(dir, "SHA256SUMS"), []byte(strings.Join(sums, "\n")+"\n"), 0644)
+
+	return archive, err
+}
+
+// addToZip stores a file in the archive and returns its SHA-256.
+func addToZip(w *zip.Writer, file string, name string) (string, error) {
+
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return "", err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	entry, err := w.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(entry, h), in); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commandsSign imports the signing key in the GnuPG home directory and
+// makes a detached armored signature of each file.
+func commandsSign(signing Signing, home string, files ...string) []*exec.Cmd {
+
+	var cmds []*exec.Cmd
+	imp := exec.Command("gpg", "--homedir", home, "--batch", "--import")
+	imp.Stdin = strings.NewReader(signing.Key)
+	cmds = append(cmds, imp)
+
+	for _, file := range files {
+		options := []string{"--homedir", home, "--batch", "--yes", "--armor", "--detach-sign"}
+		if signing.Passphrase != "" {
+			options = append(options, "--pinentry-mode", "loopback", "--passphrase-fd", "0")
+		}
+		sign := exec.Command("gpg", append(options, file)...)
+		if signing.Passphrase != "" {
+			sign.Stdin = strings.NewReader(signing.Passphrase)
+		}
+		cmds = append(cmds, sign)
+	}
+
+	return cmds
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchProfile(t *testing.T) {
+
+	profiles := []Profile{
+		{Event: []string{"tag"}},
+		{Event: []string{"push"}, Branch: []string{"main", "release/*"}},
+		{Event: []string{"pull_request", "push"}},
+	}
+
+	tests := []struct {
+		build Build
+		want  int
+	}{
+		{Build{Event: "tag"}, 0},
+		{Build{Event: "TAG"}, 0},
+		{Build{Event: "push", Branch: "main"}, 1},
+		{Build{Event: "push", Branch: "release/1.0"}, 1},
+		{Build{Event: "push", Branch: "feature"}, 2},
+		{Build{Event: "pull_request", Branch: "main"}, 2},
+		{Build{Event: "cron", Branch: "main"}, -1},
+	}
+
+	for _, tt := range tests {
+		if got := matchProfile(profiles, tt.build); got != tt.want {
+			t.Errorf("matchProfile(%+v) = %d, want %d", tt.build, got, tt.want)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		settings string
+		build    Build
+		want     string
+	}{
+		{
+			name:     "options over projects and variants",
+			settings: `{"profiles": [{"event": ["tag"], "options": {"pcb": true, "grb": null}}], "projects": [{"main": "a", "options": {"grb": {"all": true}}, "variants": [{"name": "X"}]}]}`,
+			build:    Build{Event: "tag"},
+			want:     `{"profiles": [{"event": ["tag"], "options": {"pcb": true, "grb": null}}], "projects": [{"main": "a", "options": {"pcb": true}, "variants": [{"name": "X", "options": {"pcb": true}}]}]}`,
+		},
+		{
+			name:     "no matching profile",
+			settings: `{"profiles": [{"event": ["tag"], "options": {"pcb": true}}], "projects": [{"main": "a"}]}`,
+			build:    Build{Event: "push"},
+			want:     `{"profiles": [{"event": ["tag"], "options": {"pcb": true}}], "projects": [{"main": "a"}]}`,
+		},
+		{
+			name:     "null profile",
+			settings: `{"profiles": [null], "projects": [{"main": "a"}]}`,
+			build:    Build{Event: "push"},
+			want:     `{"profiles": [null], "projects": [{"main": "a"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		var problems []string
+		got := applyProfile(jsonTree(t, tt.settings), tt.build, &problems)
+		if len(problems) > 0 {
+			t.Errorf("%s: problems %q", tt.name, problems)
+		}
+		if want := jsonTree(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Results collects the findings of the checks and the outcome of the
+// steps of a build, to be written as SARIF and JUnit XML
+type Results struct {
+	Findings []Finding
+	Steps    []StepResult
+}
+
+func (r *Results) add(findings ...Finding) {
+	r.Findings = append(r.Findings, findings...)
+}
+
+type (
+	sarifLog struct {
+		Schema  string     `json:"$schema"`
+		Version string     `json:"version"`
+		Runs    []sarifRun `json:"runs"`
+	}
+
+	sarifRun struct {
+		Tool    sarifTool     `json:"tool"`
+		Results []sarifResult `json:"results"`
+	}
+
+	sarifTool struct {
+		Driver sarifDriver `json:"driver"`
+	}
+
+	sarifDriver struct {
+		Name           string      `json:"name"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	}
+
+	sarifRule struct {
+		ID string `json:"id"`
+	}
+
+	sarifResult struct {
+		RuleID        string          `json:"ruleId"`
+		Level         string          `json:"level"`
+		Message       sarifMessage    `json:"message"`
+		Locations     []sarifLocation `json:"locations"`
+		BaselineState string          `json:"baselineState,omitempty"`
+	}
+
+	sarifMessage struct {
+		Text string `json:"text"`
+	}
+
+	sarifLocation struct {
+		PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	}
+
+	sarifPhysicalLocation struct {
+		ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+		Region           *sarifRegion          `json:"region,omitempty"`
+	}
+
+	sarifArtifactLocation struct {
+		URI       string `json:"uri"`
+		URIBaseID string `json:"uriBaseId"`
+	}
+
+	sarifRegion struct {
+		StartLine int `json:"startLine"`
+	}
+)
+
+// writeSARIF writes the findings as a SARIF 2.1.0 log, with file paths
+// relative to the workspace.
+func (r *Results) writeSARIF(file string) error {
+
+	driver := sarifDriver{
+		Name:           "drone-kicad",
+		InformationURI: "https://github.com/Toroid-io/drone-kicad",
+		Rules:          []sarifRule{},
+	}
+	rules := make(map[string]bool)
+	results := []sarifResult{}
+	for _, f := range r.Findings {
+		if !rules[f.Check] {
+			rules[f.Check] = true
+			driver.Rules = append(driver.Rules, sarifRule{f.Check})
+		}
+		location := sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{workspacePath(f.File), "%SRCROOT%"},
+		}
+		if f.Line > 0 {
+			location.Region = &sarifRegion{f.Line}
+		}
+		level := f.Severity
+		if level == "" {
+			level = SEVERITY_ERROR
+		}
+		results = append(results, sarifResult{
+			RuleID:        f.Check,
+			Level:         level,
+			Message:       sarifMessage{f.Message},
+			Locations:     []sarifLocation{{location}},
+			BaselineState: f.Baseline,
+		})
+	}
+
+	data, err := json.MarshalIndent(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{{sarifTool{driver}, results}},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// workspacePath returns a path relative to the workspace, if inside it.
+func workspacePath(file string) string {
+	if !filepath.IsAbs(file) {
+		return filepath.ToSlash(path.Clean(file))
+	}
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(file)
+}
+
+// itemRef finds the reference of the footprint or symbol a DRC or ERC item
+// is about: Footprint C3, Pad 1 of R1, Symbol U1 or Cmp #PWR01.
+var itemRef = regexp.MustCompile(`\b(?:Footprint|of|Symbol|Cmp)\s+(#?[A-Za-z_]+[0-9]+)\b`)
+
+// violationFindings locates the violations of a check in its source board
+// or schematic, at the line of the first footprint or symbol they name.
+func violationFindings(kind string, source string, violations []Violation, baseline string) []Finding {
+
+	files := make(map[string]string)
+	lines := make(map[string]int)
+	if strings.HasSuffix(source, ".kicad_pcb") {
+		if board, err := readSexpr(source); err == nil {
+			for _, fp := range boardFootprints(board) {
+				files[fp.Ref], lines[fp.Ref] = source, fp.Line
+			}
+		}
+	} else if sch, err := readSchematic(source); err == nil {
+		for _, c := range sch.Components {
+			if _, ok := lines[c.Ref]; !ok {
+				files[c.Ref], lines[c.Ref] = c.File, c.Line
+			}
+		}
+	}
+
+	var findings []Finding
+	for _, v := range violations {
+		finding := Finding{
+			File:     source,
+			Check:    kind + "/" + v.Rule,
+			Message:  violationText(v),
+			Severity: v.Severity,
+			Baseline: baseline,
+		}
+		for _, item := range v.Items {
+			if m := itemRef.FindStringSubmatch(item); m != nil && files[m[1]] != "" {
+				finding.File, finding.Line = files[m[1]], lines[m[1]]
+				break
+			}
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
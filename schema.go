@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/urfave/cli"
+)
+
+const schemaID = "https://raw.githubusercontent.com/Toroid-io/drone-kicad/master/schema.json"
+
+// requiredKeys lists the keys that must be present in objects of a type
+var requiredKeys = map[reflect.Type][]string{
+	reflect.TypeOf(Project{}):    {"main"},
+	reflect.TypeOf(Dependency{}): {"url"},
+}
+
+// shorthandKeys lists the types whose objects may be written as a single
+// string or boolean, standing for the given key
+var shorthandKeys = map[reflect.Type]string{
+	reflect.TypeOf(Dependency{}): "url",
+	reflect.TypeOf(Check{}):      "enabled",
+	reflect.TypeOf(Zones{}):      "refill",
+}
+
+// configSchema returns the JSON Schema describing the plugin settings: the
+// keys of the configuration, and the other settings Drone passes to the
+// flags as PLUGIN_* variables.
+func configSchema(flags []cli.Flag) map[string]interface{} {
+	definitions := make(map[string]interface{})
+	schema := structSchema(reflect.TypeOf(Config{}), definitions)
+	properties := schema["properties"].(map[string]interface{})
+	patterns := schema["patternProperties"].(map[string]interface{})
+	for _, f := range flags {
+		key, property := flagSchema(f)
+		if _, ok := properties[key]; key == "" || ok {
+			continue
+		}
+		properties[key] = property
+		patterns[keyPattern(key)] = property
+	}
+	schema["type"] = "object"
+	schema["definitions"] = definitions
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = schemaID
+	schema["title"] = "drone-kicad settings"
+	return schema
+}
+
+// flagSchema returns the setting key of a flag, as written in the step,
+// and the schema of its values. Flags Drone doesn't set have no key.
+func flagSchema(f cli.Flag) (string, map[string]interface{}) {
+	var key string
+	for _, env := range strings.Split(flagEnvVar(f), ",") {
+		if env = strings.TrimSpace(env); strings.HasPrefix(env, "PLUGIN_") {
+			key = strings.ToLower(strings.TrimPrefix(env, "PLUGIN_"))
+			break
+		}
+	}
+	schema := make(map[string]interface{})
+	switch f := f.(type) {
+	case cli.StringFlag:
+		schema["type"] = "string"
+		schema["description"] = f.Usage
+		if f.Value != "" {
+			schema["default"] = f.Value
+		}
+	case cli.BoolFlag:
+		schema["type"] = "boolean"
+		schema["description"] = f.Usage
+		schema["default"] = false
+	case cli.BoolTFlag:
+		schema["type"] = "boolean"
+		schema["description"] = f.Usage
+		schema["default"] = true
+	case cli.IntFlag:
+		schema["type"] = "integer"
+		schema["description"] = f.Usage
+		schema["default"] = f.Value
+	}
+	return key, schema
+}
+
+// keyPattern returns the pattern matching a key in any case, as
+// normalizeTree and Drone accept it.
+func keyPattern(key string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range key {
+		if unicode.IsLetter(r) {
+			b.WriteString("[" + string(unicode.ToLower(r)) + string(unicode.ToUpper(r)) + "]")
+		} else {
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// structSchema builds the schema of the objects of struct type t. Keys are
+// listed as written, and matched in any case like normalizeTree does.
+// Nested structs refer to their definitions.
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	patterns := make(map[string]interface{})
+	for _, f := range structKeys(t) {
+		properties[f.key] = schemaFor(f.typ, definitions)
+		patterns[keyPattern(f.key)] = properties[f.key]
+	}
+	types := []string{"object", "null"}
+	if key, ok := shorthandKeys[t]; ok {
+		field, _ := lookupKey(structKeys(t), key)
+		types = []string{"object", schemaFor(field.typ, definitions)["type"].([]string)[0], "null"}
+	}
+	schema := map[string]interface{}{
+		"type":                 types,
+		"properties":           properties,
+		"patternProperties":    patterns,
+		"additionalProperties": false,
+	}
+	if required, ok := requiredKeys[t]; ok {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaFor builds the schema of the values accepted for type t, following
+// the same key rules as normalizeTree. Every value may be null, which
+// resets an inherited setting.
+func schemaFor(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			definitions[t.Name()] = nil
+			definitions[t.Name()] = structSchema(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": schemaFor(t.Elem(), definitions),
+		}
+
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 []string{"object", "null"},
+			"additionalProperties": schemaFor(t.Elem(), definitions),
+		}
+
+	case reflect.Bool:
+		return map[string]interface{}{"type": []string{"boolean", "null"}}
+
+	case reflect.String:
+		return map[string]interface{}{"type": []string{"string", "null"}}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": []string{"integer", "null"}}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": []string{"number", "null"}}
+	}
+
+	return map[string]interface{}{}
+}
+
+// marshalSchema returns the indented schema document.
+func marshalSchema(flags []cli.Flag) ([]byte, error) {
+	data, err := json.MarshalIndent(configSchema(flags), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type (
+
+	// Component defines a schematic symbol instance
+	Component struct {
+		Ref       string            // Annotated reference (R1, U3...)
+		Value     string            // Value field
+		Footprint string            // Footprint field (Library:Footprint)
+		Symbol    string            // Library symbol (Library:Symbol)
+		Unit      int               // Unit of multi-unit symbols
+		Fields    map[string]string // User fields by name
+		File      string            // Sheet file holding the symbol
+		Line      int               // Line of the $Comp block in File
+	}
+
+	// Schematic holds the components of a (hierarchical) schematic
+	Schematic struct {
+		Root       string      // Root sheet file
+		Sheets     []string    // All sheet files, root first
+		Components []Component // Components of all sheets, every unit
+	}
+)
+
+// Field returns the named field of the component, matching case-insensitively
+// and including the Value and Footprint fields.
+func (c Component) Field(name string) string {
+	switch strings.ToLower(name) {
+	case "reference":
+		return c.Ref
+	case "value":
+		return c.Value
+	case "footprint":
+		return c.Footprint
+	}
+	for key, value := range c.Fields {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// IsPower tells whether the component is a power or flag symbol, which
+// has no footprint.
+func (c Component) IsPower() bool {
+	return strings.HasPrefix(c.Ref, "#")
+}
+
+// Parts returns one component per reference, in reference order, leaving
+// out power symbols.
+func (s Schematic) Parts() []Component {
+	seen := make(map[string]bool)
+	var parts []Component
+	for _, c := range s.Components {
+		if c.IsPower() || seen[c.Ref] {
+			continue
+		}
+		seen[c.Ref] = true
+		parts = append(parts, c)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return lessRef(parts[i].Ref, parts[j].Ref)
+	})
+	return parts
+}
+
+// Lookup returns the component with the given reference.
+func (s Schematic) Lookup(ref string) (Component, bool) {
+	for _, c := range s.Components {
+		if c.Ref == ref {
+			return c, true
+		}
+	}
+	return Component{}, false
+}
+
+// readSchematic parses a KiCad 5 schematic and all its sub-sheets. Sheets
+// used several times are read once per instance, taking the references
+// from their AR (alternate reference) entries.
+func readSchematic(file string) (Schematic, error) {
+	s := Schematic{Root: file}
+	err := s.readSheet(file, "", make(map[string]bool))
+	return s, err
+}
+
+func (s *Schematic) readSheet(file string, instance string, open map[string]bool) error {
+
+	if open[file] {
+		return fmt.Errorf("%s: recursive sheet", file)
+	}
+	open[file] = true
+	defer delete(open, file)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seen := false
+	for _, sheet := range s.Sheets {
+		if sheet == file {
+			seen = true
+		}
+	}
+	if !seen {
+		s.Sheets = append(s.Sheets, file)
+	}
+
+	type subsheet struct {
+		file      string
+		timestamp string
+	}
+	var subsheets []subsheet
+
+	var comp *Component
+	var timestamp string
+	var alternates map[string]string
+	var sheet *subsheet
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		fields := splitQuoted(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+
+		case fields[0] == "$Comp":
+			comp = &Component{File: file, Line: line, Fields: make(map[string]string)}
+			timestamp = ""
+			alternates = make(map[string]string)
+
+		case fields[0] == "$EndComp" && comp != nil:
+			if ref, ok := alternates[instance+"/"+timestamp]; ok {
+				comp.Ref = ref
+			}
+			s.Components = append(s.Components, *comp)
+			comp = nil
+
+		case comp != nil && fields[0] == "L" && len(fields) > 2:
+			comp.Symbol = fields[1]
+			comp.Ref = fields[2]
+
+		case comp != nil && fields[0] == "U" && len(fields) > 3:
+			fmt.Sscanf(fields[1], "%d", &comp.Unit)
+			timestamp = fields[3]
+
+		case comp != nil && fields[0] == "AR":
+			var ref, arPath string
+			for _, kv := range fields[1:] {
+				if strings.HasPrefix(kv, "Path=") {
+					arPath = strings.Trim(strings.TrimPrefix(kv, "Path="), `"`)
+				} else if strings.HasPrefix(kv, "Ref=") {
+					ref = strings.Trim(strings.TrimPrefix(kv, "Ref="), `"`)
+				}
+			}
+			alternates[arPath] = ref
+
+		case comp != nil && fields[0] == "F" && len(fields) > 2:
+			switch fields[1] {
+			case "0":
+			case "1":
+				comp.Value = fields[2]
+			case "2":
+				comp.Footprint = fields[2]
+			case "3":
+				comp.Fields["Datasheet"] = fields[2]
+			default:
+				if len(fields) > 10 {
+					comp.Fields[fields[10]] = fields[2]
+				}
+			}
+
+		case fields[0] == "$Sheet":
+			sheet = &subsheet{}
+
+		case sheet != nil && fields[0] == "U" && len(fields) > 1:
+			sheet.timestamp = fields[1]
+
+		case sheet != nil && fields[0] == "F1" && len(fields) > 1:
+			sheet.file = path.Join(path.Dir(file), fields[1])
+
+		case fields[0] == "$EndSheet" && sheet != nil:
+			subsheets = append(subsheets, *sheet)
+			sheet = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	for _, sub := range subsheets {
+		if err := s.readSheet(sub.file, instance+"/"+sub.timestamp, open); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitQuoted splits a schematic line on blanks, keeping quoted strings
+// (with their escapes resolved) as single fields.
+func splitQuoted(text string) []string {
+	var fields []string
+	var cur strings.Builder
+	inQuotes, escaped, started := false, false, false
+	for _, r := range text {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			started = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if started {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				started = false
+			}
+		default:
+			cur.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// lessRef orders references naturally: R2 before R10.
+func lessRef(a, b string) bool {
+	pa, na := splitRef(a)
+	pb, nb := splitRef(b)
+	if pa != pb {
+		return pa < pb
+	}
+	if na != nb {
+		return na < nb
+	}
+	return a < b
+}
+
+func splitRef(ref string) (string, int) {
+	i := len(ref)
+	for i > 0 && ref[i-1] >= '0' && ref[i-1] <= '9' {
+		i--
+	}
+	n := 0
+	fmt.Sscanf(ref[i:], "%d", &n)
+	return ref[:i], n
+}
+
+// variantSchematic returns the name of the variant copy of a schematic
+// in dir, without extension.
+func variantSchematic(sch Schematic, variant string, dir string) string {
+	return path.Join(dir, strings.TrimSuffix(path.Base(sch.Root), ".sch")+"_"+variant)
+}
+
+// writeVariantSchematic writes a copy of the schematic for a variant in
+// dir, named <sheet>_<variant>.sch with the sheets laid out as next to
+// the root sheet, together with the project, cache library and library
+// table files eeschema needs to open it. Project libraries stay where they
+// are. Overridden fields are applied and parts the variant doesn't fit
+// get a DNP value.
+func writeVariantSchematic(sch Schematic, variant string, parts []PartStatus, dir string) error {
+
+	byRef := make(map[string]PartStatus)
+	for _, p := range parts {
+		byRef[p.Ref] = p
+	}
+
+	root := path.Dir(sch.Root)
+	project, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	for _, sheet := range sch.Sheets {
+		rel, err := filepath.Rel(root, sheet)
+		if err != nil || strings.HasPrefix(filepath.ToSlash(rel), "../") {
+			return fmt.Errorf("%s: sheet outside the directory of %s", sheet, sch.Root)
+		}
+		data, err := ioutil.ReadFile(sheet)
+		if err != nil {
+			return err
+		}
+		out := path.Join(dir, strings.TrimSuffix(filepath.ToSlash(rel), ".sch")+"_"+variant+".sch")
+		if err := os.MkdirAll(path.Dir(out), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(out, []byte(rewriteSheet(string(data), variant, byRef)), 0644); err != nil {
+			return err
+		}
+	}
+
+	main := strings.TrimSuffix(sch.Root, ".sch")
+	name := variantSchematic(sch, variant, dir)
+	for _, suffix := range []string{".pro", "-cache.lib", "-rescue.lib"} {
+		data, err := ioutil.ReadFile(main + suffix)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name+suffix, data, 0644); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{symTable, fpTable} {
+		data, err := ioutil.ReadFile(path.Join(root, table))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		text := strings.Replace(string(data), "${KIPRJMOD}", project, -1)
+		if err := ioutil.WriteFile(path.Join(dir, table), []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteSheet applies the variant to the text of one sheet.
+func rewriteSheet(text string, variant string, parts map[string]PartStatus) string {
+
+	lines := strings.Split(text, "\n")
+	var out []string
+	var block []string
+	inComp := false
+
+	for _, line := range lines {
+		fields := splitQuoted(strings.TrimSpace(line))
+		switch {
+		case len(fields) > 0 && fields[0] == "$Comp":
+			inComp = true
+			block = []string{line}
+		case inComp && len(fields) > 0 && fields[0] == "$EndComp":
+			out = append(out, rewriteComponent(append(block, line), parts)...)
+			inComp = false
+		case inComp:
+			block = append(block, line)
+		case len(fields) > 1 && fields[0] == "F1":
+			sub := strings.TrimSuffix(fields[1], ".sch") + "_" + variant + ".sch"
+			out = append(out, replaceQuoted(line, sub))
+		default:
+			out = append(out, line)
+		}
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// rewriteComponent applies overrides and DNP marking to a $Comp block. A
+// block shared by several sheet instances is only changed when all its
+// references agree.
+func rewriteComponent(block []string, parts map[string]PartStatus) []string {
+
+	var ref string
+	var refs []string
+	var x, y string
+	maxField := 3
+	for _, line := range block {
+		fields := splitQuoted(strings.TrimSpace(line))
+		switch {
+		case len(fields) > 2 && fields[0] == "L":
+			ref = fields[2]
+		case len(fields) > 2 && fields[0] == "P":
+			x, y = fields[1], fields[2]
+		case len(fields) > 1 && fields[0] == "F":
+			var n int
+			fmt.Sscanf(fields[1], "%d", &n)
+			if n > maxField {
+				maxField = n
+			}
+		case len(fields) > 0 && fields[0] == "AR":
+			for _, kv := range fields[1:] {
+				if strings.HasPrefix(kv, "Ref=") {
+					refs = append(refs, strings.TrimPrefix(kv, "Ref="))
+				}
+			}
+		}
+	}
+	if len(refs) == 0 {
+		refs = []string{ref}
+	}
+
+	part, ok := parts[refs[0]]
+	if !ok {
+		return block
+	}
+	for _, ref := range refs[1:] {
+		other := parts[ref]
+		if other.Status != part.Status || strings.Join(other.Overridden, ",") != strings.Join(part.Overridden, ",") {
+			fmt.Printf("%s: sheet instances differ in the variant, left unchanged in the variant schematic\n", strings.Join(refs, ","))
+			return block
+		}
+	}
+
+	value := part.Value
+	if part.Status != PART_FITTED {
+		value = dnpKey
+	}
+
+	done := make(map[string]bool)
+	var out []string
+	for _, line := range block {
+		fields := splitQuoted(strings.TrimSpace(line))
+		if len(fields) > 2 && fields[0] == "F" {
+			switch {
+			case fields[1] == "1":
+				line = replaceQuoted(line, value)
+			case fields[1] == "2":
+				line = replaceQuoted(line, part.Footprint)
+			case fields[1] == "3":
+				if v, ok := part.Fields["Datasheet"]; ok {
+					line = replaceQuoted(line, v)
+				}
+				done["Datasheet"] = true
+			case len(fields) > 10:
+				if v, ok := part.Fields[fields[10]]; ok {
+					line = replaceQuoted(line, v)
+				}
+				done[fields[10]] = true
+			}
+		}
+		out = append(out, line)
+	}
+
+	// Add the overridden fields the symbol didn't have, hidden, before the
+	// position lines that close the block
+	var added []string
+	for _, name := range part.Overridden {
+		if v, ok := part.Fields[name]; ok && !done[name] {
+			maxField++
+			added = append(added, fmt.Sprintf("F %d %s H %s %s 50  0001 C CNN %s", maxField, quoteField(v), x, y, quoteField(name)))
+		}
+	}
+	if len(added) > 0 {
+		last := 0
+		for i, line := range out {
+			if strings.HasPrefix(line, "F ") {
+				last = i
+			}
+		}
+		out = append(out[:last+1], append(added, out[last+1:]...)...)
+	}
+
+	return out
+}
+
+// replaceQuoted replaces the first quoted string of a line.
+func replaceQuoted(line string, value string) string {
+	start := strings.Index(line, `"`)
+	if start < 0 {
+		return line
+	}
+	end := start + 1
+	for end < len(line) && line[end] != '"' {
+		if line[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(line) {
+		return line
+	}
+	return line[:start] + quoteField(value) + line[end+1:]
+}
+
+func quoteField(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
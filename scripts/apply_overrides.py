@@ -0,0 +1,93 @@
+#!/usr/bin/env python2
+# Apply per-variant value and footprint overrides to a board.
+#
+# Footprints are given as Library:Name and looked up as <Library>.pretty
+# below the --libdir directories. The new footprint takes the place,
+# orientation, side, reference, value and pad nets of the old one.
+
+import argparse
+import os
+import sys
+
+import pcbnew
+
+
+def find_library(libdirs, nickname):
+    for libdir in libdirs:
+        for root, dirs, files in os.walk(libdir):
+            if os.path.basename(root) == nickname + '.pretty':
+                return root
+    return None
+
+
+def replace_footprint(board, old, libpath, nickname, name):
+    new = pcbnew.FootprintLoad(libpath, name)
+    if new is None:
+        return False
+    new.SetFPID(pcbnew.LIB_ID(nickname, name))
+    new.SetReference(old.GetReference())
+    new.SetValue(old.GetValue())
+    new.SetTimeStamp(old.GetTimeStamp())
+    new.SetPath(old.GetPath())
+    board.Add(new)
+    if old.IsFlipped():
+        new.Flip(new.GetPosition())
+    new.SetOrientation(old.GetOrientation())
+    new.SetPosition(old.GetPosition())
+    for pad in new.Pads():
+        oldpad = old.FindPadByName(pad.GetName())
+        if oldpad is not None:
+            pad.SetNet(oldpad.GetNet())
+    board.Remove(old)
+    return True
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Apply variant overrides to a board')
+    parser.add_argument('--brd', required=True, help='board file (.kicad_pcb)')
+    parser.add_argument('--value', nargs=2, action='append', default=[],
+                        metavar=('REF', 'VALUE'), help='set the value of REF')
+    parser.add_argument('--footprint', nargs=2, action='append', default=[],
+                        metavar=('REF', 'LIB:NAME'), help='replace the footprint of REF')
+    parser.add_argument('--libdir', action='append', default=[],
+                        help='directory searched for footprint libraries')
+    args = parser.parse_args()
+
+    board = pcbnew.LoadBoard(args.brd)
+    failed = False
+
+    for ref, value in args.value:
+        module = board.FindModuleByReference(ref)
+        if module is None:
+            print('%s: no such footprint on the board' % ref)
+            failed = True
+            continue
+        print('%s: value %s -> %s' % (ref, module.GetValue(), value))
+        module.SetValue(value)
+
+    for ref, fpid in args.footprint:
+        module = board.FindModuleByReference(ref)
+        if module is None:
+            print('%s: no such footprint on the board' % ref)
+            failed = True
+            continue
+        nickname, _, name = fpid.partition(':')
+        libpath = find_library(args.libdir, nickname)
+        if libpath is None:
+            print('%s: footprint library %s not found' % (ref, nickname))
+            failed = True
+            continue
+        if not replace_footprint(board, module, libpath, nickname, name):
+            print('%s: footprint %s not found in %s' % (ref, name, libpath))
+            failed = True
+            continue
+        print('%s: footprint -> %s' % (ref, fpid))
+
+    if failed:
+        sys.exit(1)
+
+    pcbnew.SaveBoard(args.brd, board)
+
+
+if __name__ == '__main__':
+    main()
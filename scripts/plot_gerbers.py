@@ -0,0 +1,130 @@
+#!/usr/bin/env python2
+# Plot the gerbers of the layers of a board selected by name.
+#
+# Layers are given as KiCad layer names or globs (F.Cu, In*.Cu, *.Paste)
+# matched against the layers enabled on the board, so that inner copper
+# follows the layer count. Each pattern must match an enabled layer.
+
+import argparse
+import fnmatch
+import os
+import sys
+
+import pcbnew
+
+# Plot options that can be set per layer, applied to the plot parameters
+OPTIONS = {
+    'references': lambda po, v: po.SetPlotReference(v),
+    'values': lambda po, v: po.SetPlotValue(v),
+    'edgecuts': lambda po, v: po.SetExcludeEdgeLayer(not v),
+    'negative': lambda po, v: po.SetNegative(v),
+    'mirror': lambda po, v: po.SetMirror(v),
+    'subtractmask': lambda po, v: po.SetSubtractMaskFromSilk(v),
+    'tented': lambda po, v: po.SetPlotViaOnMaskLayer(not v),
+}
+
+
+def parse_bool(value):
+    if value.lower() in ('true', 'yes', '1'):
+        return True
+    if value.lower() in ('false', 'no', '0'):
+        return False
+    raise argparse.ArgumentTypeError('%s is not a boolean' % value)
+
+
+def enabled_layers(board):
+    return [(layer, board.GetLayerName(layer)) for layer in board.GetEnabledLayers().Seq()]
+
+
+def default_options(po, outdir, protel):
+    po.SetOutputDirectory(outdir)
+    po.SetPlotFrameRef(False)
+    po.SetUseGerberProtelExtensions(protel)
+    po.SetUseGerberAttributes(True)
+    po.SetScale(1)
+    po.SetMirror(False)
+    po.SetNegative(False)
+    po.SetPlotReference(True)
+    po.SetPlotValue(True)
+    po.SetSubtractMaskFromSilk(False)
+    if hasattr(po, 'SetExcludeEdgeLayer'):
+        po.SetExcludeEdgeLayer(True)
+
+
+def apply_options(po, name, options):
+    for pattern, key, value in options:
+        if not fnmatch.fnmatchcase(name, pattern):
+            continue
+        try:
+            OPTIONS[key](po, value)
+        except AttributeError:
+            print('%s: %s is not supported by this KiCad version' % (name, key))
+
+
+def plot_drill(board, outdir, splitth):
+    writer = pcbnew.EXCELLON_WRITER(board)
+    try:
+        offset = pcbnew.wxPoint(0, 0)
+    except AttributeError:
+        offset = pcbnew.VECTOR2I(0, 0)
+    writer.SetOptions(False, False, offset, not splitth)
+    writer.SetFormat(True)
+    writer.CreateDrillandMapFilesSet(outdir, True, False)
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Plot the gerbers of a board')
+    parser.add_argument('--brd', required=True, help='board file, .kicad_pcb extension optional')
+    parser.add_argument('--dir', required=True, help='output directory')
+    parser.add_argument('--layer', action='append', default=[],
+                        help='layer name or glob, e.g. In*.Cu')
+    parser.add_argument('--option', nargs=3, action='append', default=[],
+                        metavar=('LAYER', 'OPTION', 'VALUE'),
+                        help='plot option of the layers matching LAYER: %s' % ', '.join(sorted(OPTIONS)))
+    parser.add_argument('--protel', action='store_true', help='use Protel filename extensions')
+    parser.add_argument('--drl', action='store_true', help='write the drill files')
+    parser.add_argument('--splitth', action='store_true',
+                        help='split plated and non-plated through holes')
+    args = parser.parse_args()
+
+    options = []
+    for pattern, key, value in args.option:
+        if key not in OPTIONS:
+            parser.error('unknown plot option %s' % key)
+        options.append((pattern, key, parse_bool(value)))
+
+    if not args.brd.endswith('.kicad_pcb'):
+        args.brd += '.kicad_pcb'
+    board = pcbnew.LoadBoard(args.brd)
+    outdir = os.path.abspath(args.dir)
+    if not os.path.isdir(outdir):
+        os.makedirs(outdir)
+
+    layers = enabled_layers(board)
+    selected = []
+    for pattern in args.layer:
+        matched = [(layer, name) for layer, name in layers if fnmatch.fnmatchcase(name, pattern)]
+        if not matched:
+            sys.exit('%s: no enabled layer matches %s, the board has %s' %
+                     (args.brd, pattern, ', '.join(name for _, name in layers)))
+        selected += [l for l in matched if l not in selected]
+
+    pc = pcbnew.PLOT_CONTROLLER(board)
+    po = pc.GetPlotOptions()
+    for layer, name in selected:
+        default_options(po, outdir, args.protel)
+        apply_options(po, name, options)
+        pc.SetLayer(layer)
+        pc.OpenPlotfile(name, pcbnew.PLOT_FORMAT_GERBER, name)
+        if not pc.PlotLayer():
+            sys.exit('%s: plotting %s failed' % (args.brd, name))
+        print('%s plotted' % name)
+    pc.ClosePlot()
+
+    if args.drl:
+        plot_drill(board, outdir, args.splitth)
+        print('drill files written')
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,87 @@
+#!/usr/bin/env python2
+# Refill the copper zones of a board.
+#
+# With --check, the fills saved in the board are compared with the
+# refilled ones first, and the zones that differ listed: the board was
+# saved without refilling. The board is only written with --save.
+
+import argparse
+import sys
+
+import pcbnew
+
+
+def zone_layers(zone):
+    if hasattr(zone, 'GetLayerSet'):
+        return list(zone.GetLayerSet().Seq())
+    return [zone.GetLayer()]
+
+
+def filled_polys(zone, layer):
+    # KiCad 6 fills each layer of a zone apart
+    try:
+        return zone.GetFilledPolysList(layer)
+    except TypeError:
+        return zone.GetFilledPolysList()
+
+
+def chain_points(chain):
+    return tuple(sorted((chain.CPoint(i).x, chain.CPoint(i).y) for i in range(chain.PointCount())))
+
+
+def fill_signature(board, zone):
+    signature = []
+    for layer in zone_layers(zone):
+        polys = filled_polys(zone, layer)
+        outlines = []
+        for i in range(polys.OutlineCount()):
+            holes = sorted(chain_points(polys.Hole(i, h)) for h in range(polys.HoleCount(i)))
+            outlines.append((chain_points(polys.Outline(i)), tuple(holes)))
+        signature.append((board.GetLayerName(layer), tuple(sorted(outlines))))
+    return signature
+
+
+def is_rule_area(zone):
+    if hasattr(zone, 'GetIsRuleArea'):
+        return zone.GetIsRuleArea()
+    return zone.GetIsKeepout()
+
+
+def zone_name(board, zone):
+    layers = ','.join(board.GetLayerName(layer) for layer in zone_layers(zone))
+    name = zone.GetZoneName() if hasattr(zone, 'GetZoneName') else ''
+    net = zone.GetNetname() or 'no net'
+    if name:
+        return '%s (%s) on %s' % (name, net, layers)
+    return '%s on %s' % (net, layers)
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Refill the zones of a board')
+    parser.add_argument('--brd', required=True, help='board file (.kicad_pcb)')
+    parser.add_argument('--check', action='store_true',
+                        help='fail when the saved fills differ from the refilled ones')
+    parser.add_argument('--save', action='store_true', help='write the refilled board')
+    args = parser.parse_args()
+
+    board = pcbnew.LoadBoard(args.brd)
+    zones = [zone for zone in board.Zones() if not is_rule_area(zone)]
+
+    saved = [fill_signature(board, zone) for zone in zones]
+    pcbnew.ZONE_FILLER(board).Fill(board.Zones())
+    stale = [zone_name(board, zone) for zone, fill in zip(zones, saved)
+             if fill != fill_signature(board, zone)]
+
+    print('%s: %d zones refilled, %d changed' % (args.brd, len(zones), len(stale)))
+    for name in stale:
+        print('zone %s: saved fill differs from the refilled one' % name)
+
+    if args.save:
+        pcbnew.SaveBoard(args.brd, board)
+
+    if args.check and stale:
+        sys.exit('%s: %d zones were not refilled before saving' % (args.brd, len(stale)))
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,56 @@
+#!/usr/bin/env python2
+# Run the design rule check of a board and write the KiCad DRC report.
+#
+# KiCad 5 has no DRC in its scripting API, so pcbnew is started on the
+# display and its DRC dialog driven with xdotool, as the export scripts do.
+
+import argparse
+import os
+import subprocess
+import time
+
+from ui_automation import xdotool, wait_for_window, wait_for_file
+
+
+def run_gui(brd, report, wait):
+    pcb = subprocess.Popen(['pcbnew', brd])
+    try:
+        window = wait_for_window('Pcbnew', 60)
+        time.sleep(wait)
+        xdotool('windowfocus', '--sync', window)
+        # Inspect > Design Rules Checker
+        xdotool('key', 'alt+i')
+        xdotool('key', 'd')
+        dialog = wait_for_window('DRC Control', 30)
+        xdotool('windowfocus', '--sync', dialog)
+        # Tick "Create report file", give its name and run the checks
+        xdotool('key', 'alt+c')
+        xdotool('key', 'Tab')
+        xdotool('type', report)
+        xdotool('key', 'alt+r')
+        wait_for_file(report, 600)
+    finally:
+        pcb.terminate()
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Run the DRC of a board')
+    parser.add_argument('--brd', required=True, help='board file (.kicad_pcb)')
+    parser.add_argument('--report', required=True, help='report file to write')
+    parser.add_argument('--wait_init', type=int, default=5,
+                        help='seconds to wait for pcbnew to load the board')
+    args = parser.parse_args()
+
+    report = os.path.abspath(args.report)
+    if not os.path.isdir(os.path.dirname(report)):
+        os.makedirs(os.path.dirname(report))
+    if os.path.exists(report):
+        os.remove(report)
+
+    run_gui(os.path.abspath(args.brd), report, args.wait_init)
+
+    print('DRC report written to %s' % report)
+
+
+if __name__ == '__main__':
+    main()
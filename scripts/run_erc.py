@@ -0,0 +1,56 @@
+#!/usr/bin/env python2
+# Run the electrical rule check of a schematic and write the KiCad ERC
+# report.
+#
+# eeschema has no scripting API: it is started on the display and its ERC
+# dialog driven with xdotool, as the export scripts do.
+
+import argparse
+import os
+import subprocess
+import time
+
+from ui_automation import xdotool, wait_for_window, wait_for_file
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Run the ERC of a schematic')
+    parser.add_argument('--sch', required=True, help='root schematic file (.sch)')
+    parser.add_argument('--report', required=True, help='report file to write')
+    parser.add_argument('--wait_init', type=int, default=5,
+                        help='seconds to wait for eeschema to load the schematic')
+    args = parser.parse_args()
+
+    report = os.path.abspath(args.report)
+    if not os.path.isdir(os.path.dirname(report)):
+        os.makedirs(os.path.dirname(report))
+    if os.path.exists(report):
+        os.remove(report)
+
+    sch = subprocess.Popen(['eeschema', os.path.abspath(args.sch)])
+    try:
+        window = wait_for_window('Eeschema', 60)
+        time.sleep(args.wait_init)
+        xdotool('windowfocus', '--sync', window)
+        # Inspect > Electrical Rules Checker
+        xdotool('key', 'alt+i')
+        xdotool('key', 'e')
+        dialog = wait_for_window('Electrical Rules Checker', 30)
+        xdotool('windowfocus', '--sync', dialog)
+        # Tick "Create ERC file report" and run, then name the report
+        xdotool('key', 'alt+c')
+        xdotool('key', 'alt+r')
+        save = wait_for_window('ERC File', 60)
+        xdotool('windowfocus', '--sync', save)
+        xdotool('key', 'ctrl+a')
+        xdotool('type', report)
+        xdotool('key', 'Return')
+        wait_for_file(report, 600)
+    finally:
+        sch.terminate()
+
+    print('ERC report written to %s' % report)
+
+
+if __name__ == '__main__':
+    main()
@@ -0,0 +1,33 @@
+# Helpers driving the KiCad windows with xdotool, for the scripts running
+# what KiCad 5 only offers in its user interface.
+
+import os
+import subprocess
+import time
+
+
+def xdotool(*args):
+    return subprocess.check_output(['xdotool'] + list(args)).strip()
+
+
+def wait_for_window(name, timeout):
+    end = time.time() + timeout
+    while time.time() < end:
+        try:
+            return xdotool('search', '--onlyvisible', '--name', name).splitlines()[0]
+        except subprocess.CalledProcessError:
+            time.sleep(1)
+    raise RuntimeError('no %s window after %d seconds' % (name, timeout))
+
+
+def wait_for_file(path, timeout):
+    end = time.time() + timeout
+    while time.time() < end:
+        if os.path.exists(path):
+            # The file is complete once its size stops changing
+            size = os.path.getsize(path)
+            time.sleep(1)
+            if size == os.path.getsize(path):
+                return
+        time.sleep(1)
+    raise RuntimeError('no %s after %d seconds' % (path, timeout))
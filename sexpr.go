@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Node is an s-expression as used by KiCad board, footprint and library
+// table files: either an atom or a list of nodes.
+type Node struct {
+	Atom   string  // Atom value, quotes removed
+	List   []*Node // Items of a list
+	IsList bool    // Whether the node is a list
+	Line   int     // Line where the node starts
+}
+
+// Name returns the first atom of a list, which KiCad uses as its keyword.
+func (n *Node) Name() string {
+	if !n.IsList || len(n.List) == 0 || n.List[0].IsList {
+		return ""
+	}
+	return n.List[0].Atom
+}
+
+// Arg returns the i-th atom after the keyword, or "".
+func (n *Node) Arg(i int) string {
+	if !n.IsList || i+1 >= len(n.List) || n.List[i+1].IsList {
+		return ""
+	}
+	return n.List[i+1].Atom
+}
+
+// Child returns the first child list with the given keyword.
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.List {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Children returns the child lists with the given keyword.
+func (n *Node) Children(name string) []*Node {
+	var children []*Node
+	for _, c := range n.List {
+		if c.Name() == name {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// Walk calls fn for the node and each list below it, depth first.
+func (n *Node) Walk(fn func(*Node)) {
+	if !n.IsList {
+		return
+	}
+	fn(n)
+	for _, c := range n.List {
+		c.Walk(fn)
+	}
+}
+
+// readSexpr parses an s-expression file.
+func readSexpr(file string) (*Node, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	node, err := parseSexpr(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return node, nil
+}
+
+// parseSexpr parses the first s-expression of text.
+func parseSexpr(text string) (*Node, error) {
+	p := sexprParser{text: text, line: 1}
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return nil, fmt.Errorf("empty file")
+	}
+	return p.parse()
+}
+
+type sexprParser struct {
+	text string
+	pos  int
+	line int
+}
+
+func (p *sexprParser) skipSpace() {
+	for p.pos < len(p.text) && strings.IndexByte(" \t\r\n", p.text[p.pos]) >= 0 {
+		if p.text[p.pos] == '\n' {
+			p.line++
+		}
+		p.pos++
+	}
+}
+
+func (p *sexprParser) parse() (*Node, error) {
+
+	node := &Node{Line: p.line}
+
+	switch p.text[p.pos] {
+
+	case '(':
+		node.IsList = true
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.text) {
+				return nil, fmt.Errorf("line %d: unclosed list", node.Line)
+			}
+			if p.text[p.pos] == ')' {
+				p.pos++
+				return node, nil
+			}
+			child, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			node.List = append(node.List, child)
+		}
+
+	case ')':
+		return nil, fmt.Errorf("line %d: unexpected )", p.line)
+
+	case '"':
+		var b strings.Builder
+		p.pos++
+		for p.pos < len(p.text) && p.text[p.pos] != '"' {
+			c := p.text[p.pos]
+			if c == '\\' && p.pos+1 < len(p.text) {
+				p.pos++
+				c = p.text[p.pos]
+				if c == 'n' {
+					c = '\n'
+				}
+			}
+			if c == '\n' {
+				p.line++
+			}
+			b.WriteByte(c)
+			p.pos++
+		}
+		if p.pos >= len(p.text) {
+			return nil, fmt.Errorf("line %d: unclosed string", node.Line)
+		}
+		p.pos++
+		node.Atom = b.String()
+		return node, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.text) && strings.IndexByte(" \t\r\n()", p.text[p.pos]) < 0 {
+		p.pos++
+	}
+	node.Atom = p.text[start:p.pos]
+	return node, nil
+}
+
+// String formats the node on a single line, quoting atoms as needed.
+func (n *Node) String() string {
+	if !n.IsList {
+		return quoteAtom(n.Atom)
+	}
+	items := make([]string, len(n.List))
+	for i, c := range n.List {
+		items[i] = c.String()
+	}
+	return "(" + strings.Join(items, " ") + ")"
+}
+
+func quoteAtom(atom string) string {
+	if atom != "" && strings.IndexAny(atom, " \t\r\n()\"\\") < 0 {
+		return atom
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(atom) + `"`
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Dependency source types
+const (
+	SOURCE_GIT     = "git"     // Repository, cloned
+	SOURCE_PATH    = "path"    // Local directory, symlinked
+	SOURCE_ARCHIVE = "archive" // Tar or zip archive, extracted
+)
+
+// archiveExts are the supported archive extensions
+var archiveExts = []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar", ".zip"}
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+// shaFile records the checksum of the archive a directory was extracted
+// from, so that unchanged archives are not extracted again
+const shaFile = ".drone-kicad.sha256"
+
+// kind returns the source type of a dependency: its type if set, else an
+// archive for archive extensions, a path for file:// URLs and paths, and
+// a git repository otherwise.
+func (d Dependency) kind() string {
+	if d.Type != "" {
+		return d.Type
+	}
+	if archiveExt(d.URL) != "" {
+		return SOURCE_ARCHIVE
+	}
+	if strings.HasPrefix(d.URL, "file://") || !strings.Contains(d.URL, ":") {
+		return SOURCE_PATH
+	}
+	return SOURCE_GIT
+}
+
+// name returns the directory name of a dependency: the last element of its
+// URL without the .git or archive extension.
+func (d Dependency) name() string {
+	name := strings.TrimRight(d.URL, "/")
+	if ext := archiveExt(name); ext != "" {
+		name = strings.TrimSuffix(name, ext)
+	} else {
+		name = strings.TrimSuffix(name, ".git")
+	}
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// localPath returns the file a file:// URL or a path points to.
+func (d Dependency) localPath() string {
+	return strings.TrimPrefix(d.URL, "file://")
+}
+
+func archiveExt(url string) string {
+	lower := strings.ToLower(url)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// checkDependency returns what is wrong with a dependency, or "".
+func checkDependency(dep Dependency) string {
+	switch dep.kind() {
+	case SOURCE_GIT:
+		if dep.Sha256 != "" {
+			return "sha256 is only for archives"
+		}
+	case SOURCE_PATH:
+		if dep.Ref != "" || dep.Sha256 != "" {
+			return "ref and sha256 are not used for paths"
+		}
+	case SOURCE_ARCHIVE:
+		if archiveExt(dep.URL) == "" {
+			return fmt.Sprintf("url: expected one of the %s extensions", strings.Join(archiveExts, ", "))
+		}
+		if !sha256Pattern.MatchString(dep.Sha256) {
+			return "sha256: required for archives, as 64 hexadecimal digits"
+		}
+		if dep.Ref != "" {
+			return "ref is only for git repositories"
+		}
+	default:
+		return fmt.Sprintf("type: %q is not one of %s, %s, %s", dep.Type, SOURCE_GIT, SOURCE_PATH, SOURCE_ARCHIVE)
+	}
+	return ""
+}
+
+// linkPath symlinks the directory of a local dependency, relative paths
+// being relative to the workspace.
+func linkPath(out *bytes.Buffer, job fetchJob) error {
+
+	target, err := filepath.Abs(job.localPath())
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(target); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", target)
+	}
+
+	if info, err := os.Lstat(job.Dir); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("exists and is not a link")
+		}
+		if err := os.Remove(job.Dir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path.Dir(job.Dir), 0777); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "linking %s to %s\n", job.Dir, target)
+	return os.Symlink(target, job.Dir)
+}
+
+// fetchArchive downloads an archive, or opens a local one, checks its
+// checksum and extracts it. A single top directory in the archive, such
+// as mylib-1.0/, is stripped. Archives are kept by checksum in the cache directory, if any.
+func fetchArchive(out *bytes.Buffer, job fetchJob, cache string) error {
+
+	sum := strings.ToLower(job.Sha256)
+	if data, err := ioutil.ReadFile(path.Join(job.Dir, shaFile)); err == nil && strings.TrimSpace(string(data)) == sum {
+		fmt.Fprintf(out, "%s is up to date\n", job.Dir)
+		return nil
+	}
+
+	file, cleanup, err := archiveFile(out, job, cache)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if got, err := sha256File(file); err != nil {
+		return err
+	} else if got != sum {
+		if file != job.localPath() {
+			os.Remove(file)
+		}
+		return fmt.Errorf("%s: sha256 is %s, expected %s", job.URL, got, sum)
+	}
+
+	if err := os.MkdirAll(path.Dir(job.Dir), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(path.Dir(job.Dir), "."+path.Base(job.Dir))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	fmt.Fprintf(out, "extracting %s into %s\n", job.URL, job.Dir)
+	if archiveExt(job.URL) == ".zip" {
+		err = extractZip(file, tmp)
+	} else {
+		err = extractTar(file, archiveExt(job.URL), tmp)
+	}
+	if err != nil {
+		return err
+	}
+
+	root := tmp
+	if entries, err := ioutil.ReadDir(tmp); err == nil && len(entries) == 1 && entries[0].IsDir() && !isLibraryDir(entries[0].Name()) {
+		root = path.Join(tmp, entries[0].Name())
+	}
+	if err := ioutil.WriteFile(path.Join(root, shaFile), []byte(sum+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(job.Dir); err != nil {
+		return err
+	}
+	return os.Rename(root, job.Dir)
+}
+
+// isLibraryDir tells whether a directory is a KiCad footprint library or
+// 3D model directory, which is kept whole when alone in an archive.
+func isLibraryDir(name string) bool {
+	return strings.HasSuffix(name, ".pretty") || strings.HasSuffix(name, ".3dshapes")
+}
+
+// archiveFile returns the local file of an archive, downloading it if
+// needed, and a function removing it if it is temporary.
+func archiveFile(out *bytes.Buffer, job fetchJob, cache string) (string, func(), error) {
+
+	nothing := func() {}
+	if !strings.Contains(job.URL, "://") || strings.HasPrefix(job.URL, "file://") {
+		return job.localPath(), nothing, nil
+	}
+
+	var file string
+	cleanup := nothing
+	if cache != "" {
+		file = path.Join(cache, "archives", strings.ToLower(job.Sha256)+archiveExt(job.URL))
+		if _, err := os.Stat(file); err == nil {
+			fmt.Fprintf(out, "using cached %s\n", file)
+			return file, nothing, nil
+		}
+		if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+			return "", nothing, err
+		}
+	} else {
+		f, err := ioutil.TempFile("", "drone-kicad-archive")
+		if err != nil {
+			return "", nothing, err
+		}
+		f.Close()
+		file = f.Name()
+		cleanup = func() { os.Remove(file) }
+	}
+
+	fmt.Fprintf(out, "downloading %s\n", job.URL)
+	if err := download(job.URL, file); err != nil {
+		cleanup()
+		return "", nothing, err
+	}
+
+	return file, cleanup, nil
+}
+
+// download writes the content at url to file, through a temporary file so
+// that interrupted downloads don't end up in the cache.
+func download(url string, file string) error {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	currentAuth.authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	tmp := file + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// safeJoin joins an archive entry name to dir, refusing names escaping it.
+func safeJoin(dir string, name string) (string, error) {
+	clean := path.Clean(filepath.ToSlash(name))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s: path outside of the archive", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+func extractTar(file string, ext string, dir string) error {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch ext {
+	case ".tar.gz", ".tgz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ".tar.bz2", ".tbz2":
+		r = bzip2.NewReader(f)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target, err := safeJoin(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0777)
+		case tar.TypeReg:
+			err = writeEntry(target, os.FileMode(header.Mode), tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(file string, dir string) error {
+
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, entry := range r.File {
+		target, err := safeJoin(dir, entry.Name)
+		if err != nil {
+			return err
+		}
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+			continue
+		}
+		in, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = writeEntry(target, entry.Mode(), in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(target string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
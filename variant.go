@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// variantField is the symbol field holding the variant keys of a part
+const variantField = "variant"
+
+// dnpKey marks a part as never fitted, in the variant field or as a field
+// of its own. Its footprint stays on the board.
+const dnpKey = "DNP"
+
+const (
+	PART_FITTED  = "fitted"
+	PART_REMOVED = "removed"
+	PART_DNP     = "dnp"
+)
+
+type (
+
+	// VariantExpr is a parsed variant expression. Identifiers are true when
+	// the part is tagged with them.
+	VariantExpr interface {
+		Eval(keys map[string]bool) bool
+		String() string
+	}
+
+	exprKey string
+	exprNot struct{ x VariantExpr }
+	exprAnd struct{ x, y VariantExpr }
+	exprOr  struct{ x, y VariantExpr }
+
+	// PartStatus is the outcome of a variant for one part
+	PartStatus struct {
+		Component
+		Keys       []string // Variant keys of the part
+		Status     string   // PART_FITTED, PART_REMOVED or PART_DNP
+		Overridden []string // Fields overridden by the variant
+	}
+)
+
+func (e exprKey) Eval(keys map[string]bool) bool { return keys[strings.ToUpper(string(e))] }
+func (e exprNot) Eval(keys map[string]bool) bool { return !e.x.Eval(keys) }
+func (e exprAnd) Eval(keys map[string]bool) bool { return e.x.Eval(keys) && e.y.Eval(keys) }
+func (e exprOr) Eval(keys map[string]bool) bool  { return e.x.Eval(keys) || e.y.Eval(keys) }
+
+func (e exprKey) String() string { return string(e) }
+func (e exprNot) String() string { return "!" + e.x.String() }
+func (e exprAnd) String() string { return "(" + e.x.String() + " && " + e.y.String() + ")" }
+func (e exprOr) String() string  { return "(" + e.x.String() + " || " + e.y.String() + ")" }
+
+// parseVariantExpr parses a variant expression made of keys, `!`, `&&`,
+// `||` and parentheses. A comma is an alias of `||`, so the former
+// `OPT1,OPT2` lists keep their meaning. An empty expression matches no
+// tagged part.
+func parseVariantExpr(s string) (VariantExpr, error) {
+
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	p := exprParser{src: s}
+	p.next()
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.tok, p.start)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	src   string
+	pos   int
+	start int
+	tok   string
+}
+
+// next reads the next token into p.tok, "" at the end of input.
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	rest := p.src[p.pos:]
+	for _, op := range []string{"&&", "||", "!", "(", ")", ","} {
+		if strings.HasPrefix(rest, op) {
+			p.tok = op
+			p.pos += len(op)
+			return
+		}
+	}
+	end := p.pos
+	for end < len(p.src) && isKeyChar(p.src[end]) {
+		end++
+	}
+	if end == p.pos {
+		end++
+	}
+	p.tok = p.src[p.pos:end]
+	p.pos = end
+}
+
+func isKeyChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || c == '+' ||
+		(c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (p *exprParser) parseOr() (VariantExpr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "||" || p.tok == "," {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = exprOr{x, y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseAnd() (VariantExpr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "&&" {
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = exprAnd{x, y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (VariantExpr, error) {
+	switch {
+	case p.tok == "!":
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{x}, nil
+	case p.tok == "(":
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing ) at offset %d", p.start)
+		}
+		p.next()
+		return x, nil
+	case p.tok != "" && isKeyChar(p.tok[0]):
+		key := exprKey(p.tok)
+		p.next()
+		return key, nil
+	case p.tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", p.tok, p.start)
+}
+
+// partKeys returns the variant keys a part is tagged with. The variant
+// field may hold several keys separated by commas, semicolons or blanks.
+func partKeys(c Component) []string {
+	return strings.FieldsFunc(c.Field(variantField), func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t'
+	})
+}
+
+// isDNP tells whether a part is marked as never fitted.
+func isDNP(c Component, keys []string) bool {
+	for _, key := range keys {
+		if strings.EqualFold(key, dnpKey) {
+			return true
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(c.Field(dnpKey))) {
+	case "", "0", "no", "false", "n":
+		return false
+	}
+	return true
+}
+
+// variantParts decides which parts a variant fits. Untagged parts are
+// always fitted, DNP parts never, and the others when the variant
+// expression holds for their keys. Parts that are not fitted are removed
+// from the board, except DNP parts.
+func variantParts(sch Schematic, variant Variant) ([]PartStatus, error) {
+
+	expr, err := parseVariantExpr(variant.Content)
+	if err != nil {
+		return nil, fmt.Errorf("variant %s: %s", variant.Name, err)
+	}
+
+	var refs []string
+	for _, c := range sch.Parts() {
+		refs = append(refs, c.Ref)
+	}
+	for ref := range variant.Parts {
+		if _, ok := sch.Lookup(ref); !ok {
+			return nil, fmt.Errorf("variant %s: %s", variant.Name, unknownRef("parts", ref, refs))
+		}
+	}
+
+	var parts []PartStatus
+	for _, c := range sch.Parts() {
+		keys := partKeys(c)
+		status := PART_FITTED
+		if explicit, ok := variant.Parts[c.Ref]; ok {
+			status = explicit
+		} else if isDNP(c, keys) {
+			status = PART_DNP
+		} else if len(keys) > 0 {
+			set := make(map[string]bool)
+			for _, key := range keys {
+				set[strings.ToUpper(key)] = true
+			}
+			if expr == nil || !expr.Eval(set) {
+				status = PART_REMOVED
+			}
+		}
+		parts = append(parts, PartStatus{Component: c, Keys: keys, Status: status})
+	}
+
+	if err := applyOverrides(parts, variant.Overrides); err != nil {
+		return nil, fmt.Errorf("variant %s: %s", variant.Name, err)
+	}
+
+	return parts, nil
+}
+
+// applyOverrides sets the fields a variant overrides on its parts. Each
+// overridden reference must exist in the schematic.
+func applyOverrides(parts []PartStatus, overrides map[string]map[string]string) error {
+
+	var refs []string
+	index := make(map[string]int)
+	for i, p := range parts {
+		refs = append(refs, p.Ref)
+		index[p.Ref] = i
+	}
+
+	var names []string
+	for ref := range overrides {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+
+	for _, ref := range names {
+		i, ok := index[ref]
+		if !ok {
+			return unknownRef("overrides", ref, refs)
+		}
+
+		part := &parts[i]
+		fields := make(map[string]string, len(part.Fields))
+		for key, value := range part.Fields {
+			fields[key] = value
+		}
+		for name, value := range overrides[ref] {
+			switch strings.ToLower(name) {
+			case "reference":
+				return fmt.Errorf("overrides.%s: the reference can't be overridden", ref)
+			case "value":
+				part.Value = value
+			case "footprint":
+				part.Footprint = value
+			default:
+				for key := range fields {
+					if strings.EqualFold(key, name) {
+						name = key
+					}
+				}
+				fields[name] = value
+			}
+			part.Overridden = append(part.Overridden, name)
+		}
+		part.Fields = fields
+		sort.Strings(part.Overridden)
+	}
+
+	return nil
+}
+
+// writeVariantReport writes the fitted/removed list of a variant as CSV
+// and prints a summary.
+func writeVariantReport(file string, variant string, parts []PartStatus) error {
+
+	if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"Reference", "Value", "Footprint", "Keys", "Status", "Overrides"})
+	count := make(map[string]int)
+	var removed []string
+	for _, p := range parts {
+		w.Write([]string{p.Ref, p.Value, p.Footprint, strings.Join(p.Keys, " "), p.Status, strings.Join(p.Overridden, " ")})
+		count[p.Status]++
+		if p.Status == PART_REMOVED {
+			removed = append(removed, p.Ref)
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("variant %s: %d fitted, %d removed, %d DNP\n",
+		variant, count[PART_FITTED], count[PART_REMOVED], count[PART_DNP])
+	if len(removed) > 0 {
+		fmt.Printf("variant %s: removing %s\n", variant, strings.Join(removed, " "))
+	}
+
+	return w.Error()
+}
+
+// writeVariantBOM writes the BOM of a variant as CSV. Parts with the same
+// value, footprint and fields are grouped on one line; DNP parts follow
+// the fitted ones and removed parts are left out.
+func writeVariantBOM(file string, parts []PartStatus) error {
+
+	if err := os.MkdirAll(path.Dir(file), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Columns for every user field of the listed parts
+	names := make(map[string]bool)
+	for _, p := range parts {
+		for name := range p.Fields {
+			if !strings.EqualFold(name, variantField) && !strings.EqualFold(name, dnpKey) {
+				names[name] = true
+			}
+		}
+	}
+	var columns []string
+	for name := range names {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	type group struct {
+		refs   []string
+		record []string
+		fitted bool
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, p := range parts {
+		if p.Status == PART_REMOVED {
+			continue
+		}
+		fitted := p.Status == PART_FITTED
+		record := []string{p.Value, p.Footprint}
+		for _, name := range columns {
+			record = append(record, p.Fields[name])
+		}
+		key := fmt.Sprintf("%v%q", fitted, record)
+		g, ok := index[key]
+		if !ok {
+			g = &group{record: record, fitted: fitted}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.refs = append(g.refs, p.Ref)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].fitted && !groups[j].fitted
+	})
+
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"Item", "Qty", "Reference(s)", "Value", "Footprint"}, append(columns, "Fitted")...))
+	for i, g := range groups {
+		qty, fitted := len(g.refs), "yes"
+		if !g.fitted {
+			qty, fitted = 0, dnpKey
+		}
+		record := []string{fmt.Sprint(i + 1), fmt.Sprint(qty), strings.Join(g.refs, " ")}
+		record = append(record, g.record...)
+		w.Write(append(record, fitted))
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+// unknownRef reports a reference missing from the schematic, suggesting
+// the closest one.
+func unknownRef(key string, ref string, refs []string) error {
+	if s := suggest(ref, refs); s != "" {
+		return fmt.Errorf("%s.%s: no such reference in the schematic, did you mean %q?", key, ref, s)
+	}
+	return fmt.Errorf("%s.%s: no such reference in the schematic", key, ref)
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestParseVariantExpr(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		want string // Parsed form, empty for no expression
+		err  string // Expected error, empty if none
+	}{
+		{expr: "", want: ""},
+		{expr: "  ", want: ""},
+		{expr: "LITE", want: "LITE"},
+		{expr: "A,B", want: "(A || B)"},
+		{expr: "A, B, C", want: "((A || B) || C)"},
+		{expr: "A || B && C", want: "(A || (B && C))"},
+		{expr: "A && B || C", want: "((A && B) || C)"},
+		{expr: "(A || B) && C", want: "((A || B) && C)"},
+		{expr: "!A && B", want: "(!A && B)"},
+		{expr: "!(A || B)", want: "!(A || B)"},
+		{expr: "!!A", want: "!!A"},
+		{expr: "OPT_1 && v2.0 || rev-b", want: "((OPT_1 && v2.0) || rev-b)"},
+		{expr: "A &&", err: "unexpected end of expression"},
+		{expr: "(A || B", err: "missing ) at offset 7"},
+		{expr: "A B", err: `unexpected "B" at offset 2`},
+		{expr: "A )", err: `unexpected ")" at offset 2`},
+		{expr: "A & B", err: `unexpected "&" at offset 2`},
+		{expr: ",A", err: `unexpected "," at offset 0`},
+	}
+
+	for _, tt := range tests {
+		e, err := parseVariantExpr(tt.expr)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseVariantExpr(%q): error %v, want %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVariantExpr(%q): %v", tt.expr, err)
+			continue
+		}
+		got := ""
+		if e != nil {
+			got = e.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseVariantExpr(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestVariantExprEval(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		keys []string
+		want bool
+	}{
+		{"A,B", []string{"B"}, true},
+		{"A,B", []string{"C"}, false},
+		{"A && !B", []string{"A"}, true},
+		{"A && !B", []string{"A", "B"}, false},
+		{"(A || B) && C", []string{"B", "C"}, true},
+		{"(A || B) && C", []string{"C"}, false},
+		{"lite", []string{"LITE"}, true},
+	}
+
+	for _, tt := range tests {
+		e, err := parseVariantExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("parseVariantExpr(%q): %v", tt.expr, err)
+		}
+		keys := make(map[string]bool)
+		for _, key := range tt.keys {
+			keys[key] = true
+		}
+		if got := e.Eval(keys); got != tt.want {
+			t.Errorf("%q with %v = %v, want %v", tt.expr, tt.keys, got, tt.want)
+		}
+	}
+}